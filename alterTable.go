@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ALTER TABLE : add ,drop and rename columns.
+//
+// Rows are encoded by position (see `encodeValues()`) ,so when the list of columns
+// changes the old rows no longer match the `TableDef`.
+// We rewrite every row in the same tx as the new definition ,so `dbGet()` and
+// `decodeValues()` always see rows in the current shape.
+// RENAME doesnt change the positions ,only the definition is updated.
+//
+// Primary key columns cannot be added or dropped ,that would change every key.
+
+// add a column at the end ,existing rows get `def`
+// a NULL default makes the column nullable ,otherwise it is also the default for new rows
+func (db *DB) TableAddColumn(table string, col string, typ uint32, def Value) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	if err := tx.TableAddColumn(table, col, typ, def); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+func (db *DB) TableDropColumn(table string, col string) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	if err := tx.TableDropColumn(table, col); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+func (db *DB) TableRenameColumn(table string, col string, newName string) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	if err := tx.TableRenameColumn(table, col, newName); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+func (tx *DBTX) TableAddColumn(table string, col string, typ uint32, def Value) error {
+	tdef, err := alterTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	if col == "" || strings.Contains(col, JSON_PATH_OP) || slices.Contains(tdef.Cols, col) {
+		return fmt.Errorf("table %s: bad or duplicate column: %q", table, col)
+	}
+	if !validType(typ) {
+		return fmt.Errorf("table %s: column %s: bad type: %d", table, col, typ)
+	}
+	if conv, ok := convertValue(def, typ); ok {
+		def = conv // eg 0 for a FLOAT64 column
+	}
+	if def.Type != typ && def.Type != TYPE_NULL {
+		return fmt.Errorf("table %s: column %s: default value type mismatch", table, col)
+	}
+	if def.Type == TYPE_JSON && !json.Valid(def.Str) {
+		return fmt.Errorf("table %s: column %s: invalid JSON default", table, col) // before the rows are rewritten
+	}
+
+	rewriteRows(tx, tdef, func(vals []Value) []Value {
+		return append(vals, def)
+	})
+	if def.Type == TYPE_NULL || len(tdef.Nullable) != 0 {
+		for len(tdef.Nullable) < len(tdef.Cols) {
+			tdef.Nullable = append(tdef.Nullable, false)
+		}
+		tdef.Nullable = append(tdef.Nullable, def.Type == TYPE_NULL)
+	}
+	if def.Type != TYPE_NULL || len(tdef.Defaults) != 0 {
+		for len(tdef.Defaults) < len(tdef.Cols) {
+			tdef.Defaults = append(tdef.Defaults, QLNode{})
+		}
+		if def.Type == TYPE_NULL {
+			tdef.Defaults = append(tdef.Defaults, QLNode{})
+		} else {
+			tdef.Defaults = append(tdef.Defaults, qlLiteral(def))
+		}
+	}
+	tdef.Cols = append(tdef.Cols, col)
+	tdef.Types = append(tdef.Types, typ)
+	return saveTableDef(tx, tdef)
+}
+
+func (tx *DBTX) TableDropColumn(table string, col string) error {
+	tdef, err := alterTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	idx := slices.Index(tdef.Cols, col)
+	if idx < 0 {
+		return fmt.Errorf("table %s: unknown column: %s", table, col)
+	}
+	if idx < tdef.Pkeys {
+		return fmt.Errorf("table %s: cannot drop primary key column: %s", table, col)
+	}
+	for _, index := range tdef.Indexes[1:] {
+		for _, icol := range index {
+			if indexColumn(icol) == col {
+				return fmt.Errorf("table %s: column %s is used by an index", table, col)
+			}
+		}
+	}
+	for _, fk := range tdef.ForeignKeys {
+		if slices.Contains(fk.Cols, col) {
+			return fmt.Errorf("table %s: column %s is used by a foreign key", table, col)
+		}
+	}
+	for _, c := range tdef.Checks {
+		if slices.Contains(qlSymbols(c.Expr), col) {
+			return fmt.Errorf("table %s: column %s is used by %s", table, col, checkName(c))
+		}
+	}
+
+	rewriteRows(tx, tdef, func(vals []Value) []Value {
+		i := idx - tdef.Pkeys // the values dont include the primary key
+		return slices.Delete(vals, i, i+1)
+	})
+	tdef.Cols = slices.Delete(tdef.Cols, idx, idx+1)
+	tdef.Types = slices.Delete(tdef.Types, idx, idx+1)
+	if idx < len(tdef.Nullable) {
+		tdef.Nullable = slices.Delete(tdef.Nullable, idx, idx+1)
+	}
+	if idx < len(tdef.Defaults) {
+		tdef.Defaults = slices.Delete(tdef.Defaults, idx, idx+1)
+	}
+	return saveTableDef(tx, tdef)
+}
+
+func (tx *DBTX) TableRenameColumn(table string, col string, newName string) error {
+	tdef, err := alterTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	idx := slices.Index(tdef.Cols, col)
+	if idx < 0 {
+		return fmt.Errorf("table %s: unknown column: %s", table, col)
+	}
+	if newName == "" || strings.Contains(newName, JSON_PATH_OP) || slices.Contains(tdef.Cols, newName) {
+		return fmt.Errorf("table %s: bad or duplicate column: %q", table, newName)
+	}
+	tdef.Cols[idx] = newName
+	// the indexes refer to columns by name
+	for _, index := range tdef.Indexes {
+		for i := range index {
+			if indexColumn(index[i]) == col {
+				index[i] = newName + index[i][len(col):] // keeps the JSON path
+			}
+		}
+	}
+	for _, fk := range tdef.ForeignKeys {
+		if i := slices.Index(fk.Cols, col); i >= 0 {
+			fk.Cols[i] = newName
+		}
+	}
+	for i := range tdef.Checks {
+		qlRenameSymbol(&tdef.Checks[i].Expr, col, newName)
+	}
+	return saveTableDef(tx, tdef)
+}
+
+// a copy of the definition to modify and save with `saveTableDef()`
+func alterTableDef(tx *DBTX, table string) (*TableDef, error) {
+	if strings.HasPrefix(table, "@") {
+		return nil, fmt.Errorf("cannot alter internal table: %s", table)
+	}
+	tdef, err := findTableDef(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	return cloneTableDef(tdef), nil // the cached one is shared
+}
+
+// overwrite the definition in `@table`
+func saveTableDef(tx *DBTX, tdef *TableDef) error {
+	if err := constraintsDefCheck(tdef); err != nil {
+		return err
+	}
+	val, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	tableDefChanged(tx, tdef.Name)
+	rec := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
+	_, err = dbUpdate(tx, TDEF_TABLE, *rec, MODE_UPDATE_ONLY)
+	return err
+}
+
+// rows decoded at once by `rewriteRows()`
+const ALTER_BATCH = 1000
+
+// re-encode the non primary key values of every row with `fn`
+// the keys dont change ,so the secondary indexes stay valid
+// every row is rewritten in this tx (see above) ,but `ALTER_BATCH` rows at a time
+func rewriteRows(tx *DBTX, tdef *TableDef, fn func([]Value) []Value) {
+	start := rewriteBatch(tx, tdef, nil, fn)
+	for start != nil {
+		start = rewriteBatch(tx, tdef, start, fn)
+	}
+}
+
+// rewrite up to `ALTER_BATCH` rows after `start` (nil = from the 1st one)
+// returns the key of the last row ,or nil if there were none
+func rewriteBatch(tx *DBTX, tdef *TableDef, start []byte, fn func([]Value) []Value) []byte {
+	prefix := encodeKey(nil, tdef.Prefixes[0], nil)
+	cmp := CMP_GT
+	if start == nil {
+		start, cmp = prefix, CMP_GE
+	}
+	// collect the rows first ,the iterator would be invalidated by the updates
+	keys, rows := [][]byte(nil), [][]Value(nil)
+	for iter := tx.kv.Seek(start, cmp); iter.Valid() && len(keys) < ALTER_BATCH; iter.Next() {
+		key, val := iter.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		vals := make([]Value, len(tdef.Cols)-tdef.Pkeys)
+		for i := range vals {
+			vals[i].Type = tdef.Types[tdef.Pkeys+i]
+		}
+		decodeValues(val, vals)
+		keys = append(keys, append([]byte(nil), key...))
+		rows = append(rows, vals)
+	}
+	for i, key := range keys {
+		val := encodeValues(nil, fn(rows[i]))
+		tx.kv.Update(&UpdateReq{Key: key, Val: val, Mode: MODE_UPDATE_ONLY})
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[len(keys)-1]
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+// more rows than a batch of `rewriteRows()`
+func TestAlterRewriteBatches(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `create table t (id int, a int, b string, primary key (id))`)
+	rows := ALTER_BATCH*2 + 5
+	tx := DBTX{}
+	db.Begin(&tx)
+	for i := 0; i < rows; i++ {
+		rec := (&Record{}).AddInt64("id", int64(i)).AddInt64("a", int64(i)).AddStr("b", []byte("x"))
+		if _, err := tx.Set("t", *rec, MODE_INSERT_ONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.TableAddColumn("t", "c", TYPE_INT64, Value{Type: TYPE_INT64, I64: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TableDropColumn("t", "b"); err != nil {
+		t.Fatal(err)
+	}
+	db.Begin(&tx)
+	defer db.Abort(&tx)
+	for i := 0; i < rows; i++ {
+		rec := *(&Record{}).AddInt64("id", int64(i))
+		ok, err := tx.Get("t", &rec)
+		if !ok || err != nil || rec.Get("a").I64 != int64(i) || rec.Get("c").I64 != 7 || rec.Get("b") != nil {
+			t.Fatalf("row %d: got %v %v %+v", i, ok, err, rec)
+		}
+	}
+}
@@ -1,5 +1,15 @@
 package main
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// the tx read something that was changed by a tx committed after it began ,retry it
+var ErrTxConflict = errors.New("transaction conflict")
+
 const (
 	FLAG_DELETED = byte(1)
 	FLAG_UPDATED = byte(2)
@@ -8,8 +18,8 @@ const (
 // start <= key <= stop
 type KeyRange struct {
 	// for single key read ,the start and stop are equal
-	start []byte // starting point to read or write
-	stop []byte // ending point to read or write
+	start []byte // starting point to read or write ,nil is -infinity
+	stop []byte // ending point to read or write ,nil is +infinity (keys are never empty)
 }
 type KVTX struct {
 	db       *KV    // reference to the key value of db
@@ -17,28 +27,129 @@ type KVTX struct {
 	snapshot BTree  // read only state . points to root of the tree ,snapshot of the db before tx begins
 	pending  BTree  // pending state changes in memory ,they are local changes // it is a btree itself
 	version  uint64 // based on KV.version
-	read []KeyRange
+	read     []KeyRange // keys and ranges read by the tx ,for conflict detection
+	commitAt uint64 // set by a replica ,the version of the primary tx ,see `Replica.Apply()`
 }
 type DBTX struct {
-	kv KVTX
-	db *DB
+	kv  KVTX
+	db  *DB
+	ddl []string // tables whose definition was changed ,see tableCache.go
 }
 
 // an iterator that combines pending updates and the snapshot
+// on the same key the pending update wins ,deleted keys are skipped.
+// it only moves in the direction of the seek ,`Next()` for CMP_GT/CMP_GE
+// and `Prev()` for CMP_LT/CMP_LE
 type CombinedIter struct {
-	top *BIter // KVTX.pending
-	bot *BIter // KVTX.snapshot
+	top  *BIter // KVTX.pending
+	bot  *BIter // KVTX.snapshot
+	dir  int    // the `cmp` of the seek
+	tx   *KVTX
+	read int // index in `KVTX.read` ,the range covered so far
+}
+
+func (iter *CombinedIter) Valid() bool {
+	return iter.top.Valid() || iter.bot.Valid()
+}
+
+func (iter *CombinedIter) Deref() ([]byte, []byte) {
+	if top, _ := iter.current(); top {
+		key, val := iter.top.Deref()
+		assert(val[0] == FLAG_UPDATED)
+		return key, val[1:]
+	}
+	return iter.bot.Deref()
+}
+
+func (iter *CombinedIter) Next() {
+	assert(iter.dir > 0)
+	iter.step()
+	iter.skipDeleted()
+	iter.track()
+}
+
+func (iter *CombinedIter) Prev() {
+	assert(iter.dir < 0)
+	iter.step()
+	iter.skipDeleted()
+	iter.track()
+}
+
+// extend the read range to the current key ,or to the end of the keys
+// a key added in the range by another tx is a conflict ,see `detectConflicts()`
+func (iter *CombinedIter) track() {
+	key := []byte(nil) // infinity
+	if iter.Valid() {
+		cur, _ := iter.Deref()
+		key = append([]byte(nil), cur...)
+	}
+	r := &iter.tx.read[iter.read]
+	if iter.dir > 0 {
+		r.stop = key
+	} else {
+		r.start = key
+	}
+}
 
+// is the current key from the pending tree ,and is it in both trees ?
+func (iter *CombinedIter) current() (top bool, both bool) {
+	switch {
+	case !iter.top.Valid():
+		return false, false
+	case !iter.bot.Valid():
+		return true, false
+	}
+	k1, _ := iter.top.Deref()
+	k2, _ := iter.bot.Deref()
+	r := bytes.Compare(k1, k2)
+	if iter.dir < 0 {
+		r = -r // the bigger key comes first
+	}
+	return r <= 0, r == 0
+}
+
+// move past the current key ,in both trees if they both have it
+func (iter *CombinedIter) step() {
+	move := func(it *BIter) {
+		if iter.dir > 0 {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}
+	top, both := iter.current()
+	if top || both {
+		move(iter.top)
+	}
+	if !top || both {
+		move(iter.bot)
+	}
+}
+
+// the key was deleted by the tx ,it doesnt exist
+func (iter *CombinedIter) skipDeleted() {
+	for iter.Valid() {
+		if top, _ := iter.current(); !top {
+			return
+		}
+		if _, val := iter.top.Deref(); val[0] != FLAG_DELETED {
+			return
+		}
+		iter.step()
+	}
 }
 
 // begin a transaction
 func (kv *KV) Begin(tx *KVTX) {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
+	*tx = KVTX{} // a tx can be reused after it ended
 	// read-only snapshot,just tree root and the pages read callback
+	tx.db = kv              // store the refernce of the actual database
+	tx.version = kv.version // the version the snapshot sees
 	tx.snapshot.root = kv.tree.root // snapshot of root to revert back to the state before changes
-		chunks := kv.mmap.chunks // copied to avoid updates from writers
-	tx.snapshot.get = func(u uint64) []byte {return mmapRead(ptr,chunks)}//............ rread from mmaped pages
+	chunks := kv.mmap.chunks        // copied to avoid updates from writers
+	tx.snapshot.get = func(ptr uint64) []byte { return mmapRead(ptr, chunks) } // rread from mmaped pages
 	pages := [][]byte(nil)                                           // A slice to store in-memory B+tree nodes // read pending changes
 	tx.pending.get = func(ptr uint64) []byte { return pages[ptr-1] } // retrieve the pages from pointer
 	tx.pending.new = func(node []byte) uint64 {                      // add new pending data
@@ -46,40 +157,124 @@ func (kv *KV) Begin(tx *KVTX) {
 		return uint64(len(pages))   // rteurn pointers
 	}
 	tx.pending.del = func(uint64) {}
-	// tx.db = kv                // store the refernce of the actual database
-	// tx.meta = saveMeta(tx.db) // saves the current metadata state of the db
+	// registered like a snapshot ,the pages it reads are not reused until it ends
+	kv.ongoing = append(kv.ongoing, tx.version)
 }
 
 // READ BACK YOUR OWN WRITE (WHICH MEANS WHATEVER CHANGES YOU MADE SHOULD BE SEEN INSTANTLY TO YOU)
 func (tx *KVTX) Get(key []byte) ([]byte, bool) {
-	val, ok := tx.pending.get(key)
+	val, ok := tx.pending.Get(key)
 	switch {
 	case ok && val[0] == FLAG_UPDATED:
 		return val[1:], true
 	case ok && val[0] == FLAG_DELETED:
 		return nil, false
 	case !ok: // not in pending, check snapshot
-		return tx.snapshot.get(uint64(key[]));
-	default :
-	panic("unreachable")
+		tx.read = append(tx.read, KeyRange{key, key})
+		return tx.snapshot.Get(key)
+	default:
+		panic("unreachable")
 	}
 }
 
 // end a transaction: commit updates; rollback on error
 func (kv *KV) Commit(tx *KVTX) error {
-	// return updateOrRevert(tx.db, tx.meta) //update or revert the changes ,if there are errors
-	if len(writes) > 0 {
-		kv.history = append(kv.history, CommittedTX{kv.version, writes})
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	removeReader(kv, tx.version) // the tx ends here ,with or without an error
+	defer dropHistory(kv)        // after the conflict check
+
+	changes := collectChanges(tx)
+	if len(changes) == 0 && tx.commitAt == 0 {
+		return nil // read-only tx ,its snapshot was consistent ,nothing to persist
 	}
-		return nil
+	if err := checkWritable(kv); err != nil {
+		return err
+	}
+	if detectConflicts(kv, tx) {
+		return ErrTxConflict
+	}
+	if tx.commitAt != 0 && tx.commitAt != kv.version+1 {
+		return fmt.Errorf("%w: have %d ,got %d", ErrReplicaGap, kv.version, tx.commitAt)
+	}
+	// dont reuse pages that a snapshot can still see ,or that were freed by this update
+	kv.free.SetMaxSeq()
+	kv.free.maxVer = oldestReader(kv)
+	kv.free.curVer = kv.version + 1
+
+	// apply the pending updates to the tree
+	meta := saveMeta(kv)
+	writes := []KeyRange(nil)
+	for _, op := range changes {
+		if op.Deleted {
+			kv.tree.Delete(op.Key)
+		} else {
+			kv.tree.Insert(op.Key, op.Val)
+		}
+		writes = append(writes, KeyRange{start: op.Key, stop: op.Key})
+	}
+	// the new version goes into the meta page with the new root
+	kv.version++
+	if err := updateOrRevert(kv, meta); err != nil {
+		return err // the version is reverted too
+	}
+	kv.history = append(kv.history, CommittedTX{kv.version, writes})
+	// the tx is persisted ,send the keys and values to the change feed
+	publishChanges(kv, kv.version, changes)
+	return nil
 }
 
-func detectConflicts(kv *KV,tx *KVTX) bool{
-	for i := len(kv.history) -1 ;i>= 0;i--{
-		if !versionBefore(tx.version,kv.history[i].version){
-			break; // sorted
+// a < b ,works even when the version number wraps around
+func versionBefore(a, b uint64) bool {
+	return int64(a-b) < 0
+}
+
+// the oldest version that is still being read by a tx or a snapshot
+// pages freed at this version or later cannot be reused yet
+func oldestReader(kv *KV) uint64 {
+	if len(kv.ongoing) == 0 {
+		return kv.version + 1 // nobody is reading ,everything can be reused
+	}
+	return kv.ongoing[0] // sorted ,versions are only added in increasing order
+}
+
+// remove 1 entry of `version` from `kv.ongoing`
+func removeReader(kv *KV, version uint64) {
+	idx := slices.Index(kv.ongoing, version)
+	assert(idx >= 0)
+	kv.ongoing = slices.Delete(kv.ongoing, idx, idx+1)
+}
+
+// a tx only conflicts with txs committed after it began ,
+// drop the ones that are older than every ongoing tx
+func dropHistory(kv *KV) {
+	oldest := oldestReader(kv)
+	for len(kv.history) > 0 && !versionBefore(oldest, kv.history[0].version) {
+		kv.history = kv.history[1:]
+	}
+}
+
+func detectConflicts(kv *KV, tx *KVTX) bool {
+	for i := len(kv.history) - 1; i >= 0; i-- {
+		if !versionBefore(tx.version, kv.history[i].version) {
+			break // sorted
+		}
+		if rangeOverlap(tx.read, kv.history[i].writes) {
+			return true
 		}
-		if rangeOverlap(tx.reads,kv.history[i],writes){
+	}
+	return false
+}
+
+// does any of the `reads` contain a key in `writes` ?
+// `writes` is sorted and the ranges dont overlap
+func rangeOverlap(reads []KeyRange, writes []KeyRange) bool {
+	for _, r := range reads {
+		// the 1st write that doesnt end before the read
+		i, _ := slices.BinarySearchFunc(writes, r.start, func(w KeyRange, key []byte) int {
+			return bytes.Compare(w.stop, key)
+		})
+		if i < len(writes) && (r.stop == nil || bytes.Compare(writes[i].start, r.stop) <= 0) {
 			return true
 		}
 	}
@@ -87,10 +282,12 @@ func detectConflicts(kv *KV,tx *KVTX) bool{
 }
 
 // end a transaction: rollback
+// nothing was written to the db ,the pending updates are just dropped
 func (kv *KV) Abort(tx *KVTX) {
-	loadMeta(tx.db, tx.meta)                 // revert the db to old state
-	tx.db.page.nappend = 0                   // discard append writes
-	tx.db.page.updates = map[uint64][]byte{} //clear temporary updates
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	removeReader(kv, tx.version)
+	dropHistory(kv)
 }
 
 // Transaction (TX): A set of database operations (reads/writes) that either all happen or all undo, keeping data safe.
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func kvPut(tx *KVTX, key string, val string) {
+	tx.Update(&UpdateReq{Key: []byte(key), Val: []byte(val)})
+}
+
+func kvCommit(t *testing.T, kv *KV, key string, val string) {
+	t.Helper()
+	tx := KVTX{}
+	kv.Begin(&tx)
+	kvPut(&tx, key, val)
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTXConflictPointRead(t *testing.T) {
+	kv := openTestKV(t)
+	kvCommit(t, kv, "a", "1")
+
+	tx1, tx2 := KVTX{}, KVTX{}
+	kv.Begin(&tx1)
+	kv.Begin(&tx2)
+	// both increment the same key
+	for _, tx := range []*KVTX{&tx1, &tx2} {
+		if val, _ := tx.Get([]byte("a")); string(val) != "1" {
+			t.Fatalf("got %q", val)
+		}
+		kvPut(tx, "a", "2")
+	}
+	if err := kv.Commit(&tx1); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Commit(&tx2); !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("got %v", err)
+	}
+
+	// a write to a key the tx didnt read is not a conflict
+	kv.Begin(&tx1)
+	tx1.Get([]byte("a"))
+	kvPut(&tx1, "x", "1")
+	kvCommit(t, kv, "b", "1")
+	if err := kv.Commit(&tx1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTXConflictRange(t *testing.T) {
+	kv := openTestKV(t)
+	kvCommit(t, kv, "b", "1")
+	kvCommit(t, kv, "d", "1")
+
+	// scans from `b` and stops at `d`
+	scan := func(tx *KVTX, val string) {
+		for iter := tx.Seek([]byte("b"), CMP_GE); iter.Valid(); iter.Next() {
+			if key, _ := iter.Deref(); string(key) == "d" {
+				break
+			}
+		}
+		kvPut(tx, "z", val) // not read-only
+	}
+	cases := []struct {
+		key      string
+		conflict bool
+	}{
+		{"a", false},
+		{"c", true}, // a new key inside the scanned range
+		{"d", true},
+		{"e", false},
+	}
+	for _, c := range cases {
+		tx := KVTX{}
+		kv.Begin(&tx)
+		scan(&tx, c.key)
+		kvCommit(t, kv, c.key, "2")
+		err := kv.Commit(&tx)
+		if got := errors.Is(err, ErrTxConflict); got != c.conflict || (err != nil && !got) {
+			t.Errorf("write %s: got %v", c.key, err)
+		}
+	}
+
+	// a scan to the end covers every key after it
+	tx := KVTX{}
+	kv.Begin(&tx)
+	for iter := tx.Seek([]byte("x"), CMP_GE); iter.Valid(); iter.Next() {
+	}
+	kvPut(&tx, "0", "1")
+	kvCommit(t, kv, "zz", "1")
+	if err := kv.Commit(&tx); !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// a read-only tx never conflicts ,it saw a consistent snapshot
+func TestTXReadOnlyNoConflict(t *testing.T) {
+	kv := openTestKV(t)
+	tx := KVTX{}
+	kv.Begin(&tx)
+	tx.Get([]byte("a"))
+	kvCommit(t, kv, "a", "1")
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	// the history is dropped when no tx can conflict with it
+	if len(kv.history) != 0 {
+		t.Fatalf("history: %d", len(kv.history))
+	}
+}
+
+// a backfill batch that races with a writer is retried by `IndexNew()`
+func TestIndexBackfillConflict(t *testing.T) {
+	db := openTestDB(t)
+	err := db.TableNew(&TableDef{
+		Name:    "t",
+		Types:   []uint32{TYPE_INT64, TYPE_INT64},
+		Cols:    []string{"id", "v"},
+		Pkeys:   1,
+		Indexes: [][]string{{"id"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10; i += 2 {
+		if _, err := db.Upsert("t", *(&Record{}).AddInt64("id", i).AddInt64("v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx := DBTX{}
+	db.Begin(&tx)
+	idx, err := indexAdd(&tx, "t", []string{"v"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = DBTX{}
+	db.Begin(&tx)
+	if _, err := indexBackfill(&tx, "t", idx, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a row between the copied ones
+	if _, err := db.Upsert("t", *(&Record{}).AddInt64("id", 3).AddInt64("v", 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx); !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// more new pages than 1 `pwritev` call can take
+func TestTXLargeCommit(t *testing.T) {
+	kv := openTestKV(t)
+	tx := KVTX{}
+	kv.Begin(&tx)
+	for i := 0; i < 5000; i++ {
+		kvPut(&tx, fmt.Sprintf("key%06d", i), strings.Repeat("x", 1000))
+	}
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := kv.Get([]byte("key004999")); err != nil || len(val) != 1000 {
+		t.Fatalf("got %q %v", val, err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// Auto-increment primary keys.
+//
+// A table with `AutoInc` has 1 INT64 primary key column ,`Insert()` assigns the next id
+// when the row doesnt have one.
+// A table without a primary key (`Pkeys` = 0) gets a hidden `@rowid` column ,
+// which works the same way (see the notes on indexes).
+// It is internal : the user cannot write it ,and rows returned to the user dont have it.
+//
+// The next id is kept in `@meta` under `next_id:<table>` ,it is read and updated in
+// the inserting tx. Of 2 concurrent inserts ,the 2nd to commit fails with `ErrTxConflict`
+// (it read the counter the 1st one wrote) instead of getting the same id.
+
+// the column added to tables without a primary key
+const ROWID_COL = "@rowid"
+
+// key in `@meta` of the next id ,followed by the table name
+const META_NEXT_ID = "next_id:"
+
+// add the row id column if needed ,and check the primary key of an auto-increment table
+func autoIncCheck(tdef *TableDef) error {
+	if tdef.Pkeys == 0 {
+		tdef.Cols = append([]string{ROWID_COL}, tdef.Cols...)
+		tdef.Types = append([]uint32{TYPE_INT64}, tdef.Types...)
+		if len(tdef.Nullable) != 0 {
+			tdef.Nullable = append([]bool{false}, tdef.Nullable...)
+		}
+		if len(tdef.Defaults) != 0 {
+			tdef.Defaults = append([]QLNode{{}}, tdef.Defaults...) // no default ,assigned by `Insert()`
+		}
+		tdef.Pkeys = 1
+		tdef.AutoInc = true
+	}
+	if tdef.AutoInc && (tdef.Pkeys != 1 || tdef.Types[0] != TYPE_INT64) {
+		return fmt.Errorf("table %s: auto-increment needs a single INT64 primary key", tdef.Name)
+	}
+	return nil
+}
+
+// insert a row ,assigning its id if needed
+// returns the id ,0 for a table without auto-increment or without a primary key
+// (the user cannot use `@rowid` so it is not returned)
+func (tx *DBTX) Insert(table string, rec Record) (int64, error) {
+	tdef, err := findTableDef(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkUserCols(tdef, rec); err != nil {
+		return 0, err
+	}
+
+	id := int64(0)
+	if tdef.AutoInc && !slices.Contains(rec.Cols, tdef.Cols[0]) {
+		next, err := autoIncNext(tx, tdef)
+		if err != nil {
+			return 0, err
+		}
+		id = next
+		// copy ,dont append to the caller's slices
+		rec = Record{Cols: slices.Clone(rec.Cols), Vals: slices.Clone(rec.Vals)}
+		rec.AddInt64(tdef.Cols[0], id)
+	} else if tdef.AutoInc {
+		id = rec.Get(tdef.Cols[0]).I64
+	}
+
+	added, err := dbSet(tx, tdef, rec, MODE_INSERT_ONLY)
+	if err != nil {
+		return 0, err
+	}
+	if !added {
+		return 0, &ConstraintError{Table: table, Constraint: "primary key", Msg: "duplicate value"}
+	}
+	if tdef.Cols[0] == ROWID_COL {
+		return 0, nil
+	}
+	return id, nil
+}
+
+// read the next id from `@meta` ,ids start at 1
+func autoIncLoad(tx *DBTX, tdef *TableDef) (int64, error) {
+	meta := (&Record{}).AddStr("key", []byte(META_NEXT_ID+tdef.Name))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil || !ok {
+		return 1, err
+	}
+	return int64(binary.LittleEndian.Uint64(meta.Get("val").Str)), nil
+}
+
+func autoIncStore(tx *DBTX, tdef *TableDef, next int64) error {
+	val := make([]byte, 8)
+	binary.LittleEndian.PutUint64(val, uint64(next))
+	meta := (&Record{}).AddStr("key", []byte(META_NEXT_ID+tdef.Name)).AddStr("val", val)
+	_, err := dbUpdate(tx, TDEF_META, *meta, MODE_UPSERT)
+	return err
+}
+
+// take the next id
+func autoIncNext(tx *DBTX, tdef *TableDef) (int64, error) {
+	id, err := autoIncLoad(tx, tdef)
+	if err != nil {
+		return 0, err
+	}
+	return id, autoIncStore(tx, tdef, id+1)
+}
+
+// move the counter past an id that was written by the user
+func autoIncSeen(tx *DBTX, tdef *TableDef, id int64) error {
+	next, err := autoIncLoad(tx, tdef)
+	if err != nil || id < next {
+		return err
+	}
+	return autoIncStore(tx, tdef, id+1)
+}
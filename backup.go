@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Hot backup : copy a live database without stopping the writer.
+//
+// The backup reads from a snapshot (see snapshot.go) ,so the pages of the
+// snapshot root cant be reused while we are copying them.
+// Other pages (free list nodes ,pages freed before the snapshot) may change under us,
+// but nothing in the copy points to them, so the copy is still consistent.
+//
+// 2 modes :
+// 1. full    : page by page copy of the file ,with the meta page rewritten for the snapshot root
+// 2. compact : only the pages reachable from the root ,renumbered ,the free list is left out
+
+// written after the meta data in the meta page of a compact backup ,
+// the pages are renumbered so it cannot be the base of incremental backups
+const BACKUP_COMPACT_MARK = "compact"
+
+// copy the whole file
+func (kv *KV) Backup(w io.Writer) error {
+	snap, err := kv.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	meta := make([]byte, BTREE_PAGE_SIZE)
+	copy(meta, encodeMeta(snap.tree.root, snap.pages, snap.version))
+	if _, err := w.Write(meta); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	// page 0 is the meta page
+	for ptr := uint64(1); ptr < snap.pages; ptr++ {
+		if _, err := w.Write(snap.tree.get(ptr)); err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// copy only the live tree
+func (kv *KV) BackupCompact(w io.Writer) error {
+	snap, err := kv.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	// the output needs the meta page first ,and the meta page needs the new root ptr,
+	// so count the pages before writing them.
+	// pages are written in post order (kids before the parent) ,so the root is the last one
+	count := uint64(0)
+	if snap.tree.root != 0 {
+		count = countPages(&snap.tree, snap.tree.root)
+	}
+	meta := make([]byte, BTREE_PAGE_SIZE)
+	copy(meta, encodeMeta(count, count+1, snap.version)) // root = last page ,or 0 for an empty tree
+	copy(meta[META_SIZE:], BACKUP_COMPACT_MARK)
+	if _, err := w.Write(meta); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if snap.tree.root == 0 {
+		return nil
+	}
+
+	next := uint64(1) // the next page number in the output
+	_, err = copyPages(&snap.tree, snap.tree.root, w, &next)
+	return err
+}
+
+// number of pages in the subtree
+func countPages(tree *BTree, ptr uint64) uint64 {
+	node := BNode(tree.get(ptr))
+	n := uint64(1)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			n += countPages(tree, node.getPtr(i))
+		}
+	}
+	return n
+}
+
+// write the subtree and return the new page number of `ptr`
+func copyPages(tree *BTree, ptr uint64, w io.Writer, next *uint64) (uint64, error) {
+	node := BNode(tree.get(ptr))
+	if node.btype() == BNODE_NODE {
+		// copy it ,the mmap is read only and the pointers change
+		node = append(BNode(nil), node...)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid, err := copyPages(tree, node.getPtr(i), w, next)
+			if err != nil {
+				return 0, err
+			}
+			node.setPtr(i, kid)
+		}
+	}
+	if _, err := w.Write(node); err != nil {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	*next++
+	return *next - 1, nil
+}
+
+// backup into a new file
+// written to a temp file and renamed ,so `file` is either the complete backup or absent
+func (kv *KV) BackupFile(file string, compact bool) error {
+	tmp := file + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	defer fp.Close()
+
+	if compact {
+		err = kv.BackupCompact(fp)
+	} else {
+		err = kv.Backup(fp)
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// persist the rename
+	return syncDir(file)
+}
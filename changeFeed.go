@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// Change feed : every committed tx with its keys and values ,in version order.
+// Used to keep replicas and other indexes (eg a search index) in sync.
+//
+// `CommittedTX` only has the key ranges (for conflict detection),
+// so on commit we also copy the puts and deletes from `KVTX.pending`.
+// The last `Options.FeedSize` txs are kept in memory, a subscriber can resume
+// from any version still in there. If it fell further behind it gets `ErrFeedTooOld`
+// and has to start over from a snapshot (`KVSnapshot.Version()` is the version to resume from).
+
+var ErrFeedTooOld = errors.New("change feed: version is no longer available ,resync from a snapshot")
+var ErrSubscriptionClosed = errors.New("change feed: subscription is closed")
+
+// 1 put or delete
+type ChangeOp struct {
+	Key     []byte
+	Val     []byte // nil for deletes
+	Deleted bool
+}
+
+// everything written by 1 tx
+type ChangeRecord struct {
+	Version uint64
+	Ops     []ChangeOp // in key order
+}
+
+type ChangeFeed struct {
+	mutex   sync.Mutex // separate from KV.mutex ,subscribers wait on it
+	cond    *sync.Cond
+	records []ChangeRecord // recent txs ,in version order
+	first   uint64         // the oldest version a subscriber can resume after
+	closed  bool
+}
+
+type Subscription struct {
+	kv     *KV
+	last   uint64 // the version of the last record returned
+	closed bool
+}
+
+// the puts and deletes of a tx ,from its pending tree
+// a key that ends up as it is in the snapshot (eg added then deleted) is not a change
+func collectChanges(tx *KVTX) []ChangeOp {
+	ops := []ChangeOp(nil)
+	for iter := tx.pending.Seek(nil, CMP_GT); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		old, exists := tx.snapshot.Get(key)
+		op := ChangeOp{Key: append([]byte(nil), key...)}
+		switch val[0] {
+		case FLAG_UPDATED:
+			if exists && bytes.Equal(old, val[1:]) {
+				continue
+			}
+			op.Val = append([]byte(nil), val[1:]...)
+		case FLAG_DELETED:
+			if !exists {
+				continue
+			}
+			op.Deleted = true
+		default:
+			panic("unreachable")
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// called by `Open()` ,nothing before the current version can be resumed from
+func feedInit(kv *KV) {
+	kv.feed.cond = sync.NewCond(&kv.feed.mutex)
+	kv.feed.first = kv.version
+}
+
+// called by `Commit()` after the tx is persisted (the meta page with its version is written),
+// with `KV.mutex` held ,so records are published in version order
+func publishChanges(kv *KV, version uint64, ops []ChangeOp) {
+	feed := &kv.feed
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	feed.records = append(feed.records, ChangeRecord{Version: version, Ops: ops})
+	// drop old records
+	if extra := len(feed.records) - kv.Options.FeedSize; extra > 0 {
+		feed.first = feed.records[extra-1].Version
+		feed.records = append(feed.records[:0], feed.records[extra:]...)
+	}
+	feed.cond.Broadcast()
+}
+
+// wake up the subscribers ,called by `KV.Close()`
+func closeFeed(kv *KV) {
+	feed := &kv.feed
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	feed.closed = true
+	feed.cond.Broadcast()
+}
+
+// receive the txs committed after version `from`
+func (kv *KV) Subscribe(from uint64) (*Subscription, error) {
+	feed := &kv.feed
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if feed.closed {
+		return nil, ErrClosed
+	}
+	if versionBefore(from, feed.first) {
+		return nil, ErrFeedTooOld
+	}
+	return &Subscription{kv: kv, last: from}, nil
+}
+
+// wait for the next committed tx
+func (sub *Subscription) Next() (ChangeRecord, error) {
+	feed := &sub.kv.feed
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	for {
+		if sub.closed {
+			return ChangeRecord{}, ErrSubscriptionClosed
+		}
+		if versionBefore(sub.last, feed.first) {
+			return ChangeRecord{}, ErrFeedTooOld // too slow ,the records were dropped
+		}
+		for _, rec := range feed.records {
+			if versionBefore(sub.last, rec.Version) {
+				sub.last = rec.Version
+				return rec, nil
+			}
+		}
+		if feed.closed {
+			return ChangeRecord{}, ErrClosed
+		}
+		feed.cond.Wait()
+	}
+}
+
+// the version of the last record returned by `Next()`
+func (sub *Subscription) Version() uint64 {
+	return sub.last
+}
+
+// stop the subscription ,a blocked `Next()` returns `ErrSubscriptionClosed`
+func (sub *Subscription) Close() {
+	feed := &sub.kv.feed
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	sub.closed = true
+	feed.cond.Broadcast()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestKV(t *testing.T) *KV {
+	t.Helper()
+	kv := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	return kv
+}
+
+// the keys from `Seek()` ,in the order of the iterator
+func seekKeys(tx *KVTX, key string, cmp int) []string {
+	keys := []string(nil)
+	for iter := tx.Seek([]byte(key), cmp); iter.Valid(); {
+		k, v := iter.Deref()
+		keys = append(keys, string(k)+"="+string(v))
+		if cmp > 0 {
+			iter.Next()
+		} else {
+			iter.Prev()
+		}
+	}
+	return keys
+}
+
+func TestChangeFeedCommit(t *testing.T) {
+	kv := openTestKV(t)
+	sub, err := kv.Subscribe(kv.version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	tx := KVTX{}
+	kv.Begin(&tx)
+	tx.Update(&UpdateReq{Key: []byte("a"), Val: []byte("1")})
+	tx.Update(&UpdateReq{Key: []byte("b"), Val: []byte("2")})
+	// added and deleted by the same tx ,not a change
+	tx.Update(&UpdateReq{Key: []byte("c"), Val: []byte("3")})
+	if !tx.Del(&DeleteReq{Key: []byte("c")}) {
+		t.Fatal("the pending key is not deleted")
+	}
+	// the tx reads its own writes
+	if val, ok := tx.Get([]byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("got %q %v", val, ok)
+	}
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := sub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ChangeRecord{Version: 1, Ops: []ChangeOp{
+		{Key: []byte("a"), Val: []byte("1")},
+		{Key: []byte("b"), Val: []byte("2")},
+	}}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatalf("got %+v ,expected %+v", rec, want)
+	}
+
+	// the pending updates over the committed data
+	tx = KVTX{}
+	kv.Begin(&tx)
+	tx.Del(&DeleteReq{Key: []byte("a")})
+	tx.Update(&UpdateReq{Key: []byte("b"), Val: []byte("3")})
+	tx.Update(&UpdateReq{Key: []byte("d"), Val: []byte("4")})
+	if got := seekKeys(&tx, "", CMP_GE); !reflect.DeepEqual(got, []string{"b=3", "d=4"}) {
+		t.Fatalf("forward: %v", got)
+	}
+	if got := seekKeys(&tx, "c", CMP_LE); !reflect.DeepEqual(got, []string{"b=3"}) {
+		t.Fatalf("backward: %v", got)
+	}
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err = sub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = ChangeRecord{Version: 2, Ops: []ChangeOp{
+		{Key: []byte("a"), Deleted: true},
+		{Key: []byte("b"), Val: []byte("3")},
+		{Key: []byte("d"), Val: []byte("4")},
+	}}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatalf("got %+v ,expected %+v", rec, want)
+	}
+
+	// the db has the committed data
+	if val, _ := kv.Get([]byte("b")); string(val) != "3" {
+		t.Fatalf("got %q", val)
+	}
+	if kv.version != 2 {
+		t.Fatalf("version %d", kv.version)
+	}
+}
+
+// a tx without changes doesnt make a version
+func TestChangeFeedReadOnlyTX(t *testing.T) {
+	kv := openTestKV(t)
+	tx := KVTX{}
+	kv.Begin(&tx)
+	tx.Get([]byte("a"))
+	tx.Update(&UpdateReq{Key: []byte("a"), Val: []byte("1")})
+	tx.Del(&DeleteReq{Key: []byte("a")})
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if kv.version != 0 || len(kv.feed.records) != 0 {
+		t.Fatalf("version %d ,records %d", kv.version, len(kv.feed.records))
+	}
+}
+
+// a reader can end its txs with `Commit()` as long as they dont write
+func TestReadOnlyCommit(t *testing.T) {
+	kv := openTestKV(t)
+	kvCommit(t, kv, "a", "1")
+	reader := &KV{Path: kv.Path, Options: Options{ReadOnly: true}}
+	if err := reader.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	tx := KVTX{}
+	reader.Begin(&tx)
+	if val, _ := tx.Get([]byte("a")); string(val) != "1" {
+		t.Fatalf("got %q", val)
+	}
+	if err := reader.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	reader.Begin(&tx)
+	kvPut(&tx, "a", "2")
+	if err := reader.Commit(&tx); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Constraints are checked inside the tx that writes the row ,before anything is written.
+// A violation returns a `*ConstraintError` ,use errors.As() to get the details.
+
+type ConstraintError struct {
+	Table      string
+	Constraint string // eg `unique(email)`
+	Msg        string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("table %s: constraint %s violated: %s", e.Table, e.Constraint, e.Msg)
+}
+
+// CHECK constraints and column defaults ,both are `QLNode` expressions stored in the `TableDef`.
+//
+// A default is evaluated without a row ,when a full row doesnt have the column
+// (see `checkRecord()`). A number is converted to the column type (`price float default 0`)
+// and a string is the text of a JSON column ,otherwise it must give a value of the column type.
+// A check is evaluated on the full row before it is written (see `dbUpdate()`),
+// the row is rejected if it is FALSE ,NULL passes like in SQL. Any other value is an error.
+
+type Check struct {
+	Name string
+	Expr QLNode
+}
+
+// `check(name)`
+func checkName(c Check) string {
+	return fmt.Sprintf("check(%s)", c.Name)
+}
+
+// the default of the `i`th column ,if it has one
+func hasDefault(tdef *TableDef, i int) bool {
+	return i < len(tdef.Defaults) && tdef.Defaults[i].Type != QL_UNINIT
+}
+
+func evalDefault(tdef *TableDef, i int) (Value, error) {
+	ctx := QLEvalContex{}
+	qlEval(&ctx, tdef.Defaults[i])
+	if ctx.err != nil {
+		return Value{}, fmt.Errorf("table %s: column %s: default: %w", tdef.Name, tdef.Cols[i], ctx.err)
+	}
+	out := ctx.out
+	if out.Type == TYPE_BYTES && tdef.Types[i] == TYPE_JSON {
+		out.Type = TYPE_JSON // the document ,validated by `checkValue()`
+	} else if v, ok := convertValue(out, tdef.Types[i]); ok {
+		out = v
+	}
+	return out, checkValue(tdef, i, out)
+}
+
+// the default expression of a constant ,the literals share the `TYPE_*` values except JSON
+func qlLiteral(v Value) QLNode {
+	if v.Type == TYPE_JSON {
+		return QLNode{Value: Value{Type: QL_STR, Str: v.Str}}
+	}
+	return QLNode{Value: v}
+}
+
+// `vals` is the full row in table order
+func checkConstraints(tdef *TableDef, vals []Value) error {
+	ctx := QLEvalContex{env: Record{Cols: tdef.Cols, Vals: vals}}
+	for _, c := range tdef.Checks {
+		qlEval(&ctx, c.Expr)
+		if ctx.err != nil {
+			return fmt.Errorf("table %s: %s: %w", tdef.Name, checkName(c), ctx.err)
+		}
+		switch {
+		case ctx.out.Type == TYPE_NULL:
+			// unknown ,passes
+		case ctx.out.Type != TYPE_BOOL:
+			return fmt.Errorf("table %s: %s: expect a BOOL ,got %s", tdef.Name, checkName(c), qlTypeName(ctx.out.Type))
+		case ctx.out.I64 == 0:
+			return &ConstraintError{Table: tdef.Name, Constraint: checkName(c), Msg: "the check is false"}
+		}
+	}
+	return nil
+}
+
+// called by `tableDefCheck()` and `saveTableDef()`
+func constraintsDefCheck(tdef *TableDef) error {
+	if len(tdef.Defaults) != 0 && len(tdef.Defaults) != len(tdef.Cols) {
+		return fmt.Errorf("table %s: columns and defaults dont match", tdef.Name)
+	}
+	for i := range tdef.Defaults {
+		if !hasDefault(tdef, i) {
+			continue
+		}
+		if i < tdef.Pkeys {
+			return fmt.Errorf("table %s: primary key column %s cannot have a default", tdef.Name, tdef.Cols[i])
+		}
+		if len(qlSymbols(tdef.Defaults[i])) != 0 {
+			return fmt.Errorf("table %s: column %s: a default cannot use columns", tdef.Name, tdef.Cols[i])
+		}
+		if _, err := evalDefault(tdef, i); err != nil {
+			return err
+		}
+	}
+	for i, c := range tdef.Checks {
+		if c.Name == "" || slices.ContainsFunc(tdef.Checks[:i], func(o Check) bool { return o.Name == c.Name }) {
+			return fmt.Errorf("table %s: bad or duplicate check name: %q", tdef.Name, c.Name)
+		}
+		for _, col := range qlSymbols(c.Expr) {
+			if !slices.Contains(tdef.Cols, col) {
+				return fmt.Errorf("table %s: %s: unknown column: %s", tdef.Name, checkName(c), col)
+			}
+		}
+	}
+	return nil
+}
+
+// the columns used by an expression
+func qlSymbols(node QLNode) []string {
+	if node.Type == QL_SYM {
+		return []string{string(node.Str)}
+	}
+	syms := []string(nil)
+	for _, kid := range node.Kids {
+		syms = append(syms, qlSymbols(kid)...)
+	}
+	return syms
+}
+
+// a deep copy of an expression
+func qlClone(node QLNode) QLNode {
+	out := node
+	out.Str = slices.Clone(node.Str)
+	out.Kids = make([]QLNode, len(node.Kids))
+	for i, kid := range node.Kids {
+		out.Kids[i] = qlClone(kid)
+	}
+	return out
+}
+
+// rename a column in an expression
+func qlRenameSymbol(node *QLNode, col string, newName string) {
+	if node.Type == QL_SYM && string(node.Str) == col {
+		node.Str = []byte(newName)
+	}
+	for i := range node.Kids {
+		qlRenameSymbol(&node.Kids[i], col, newName)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func mustExec(t *testing.T, db *DB, sql string) uint64 {
+	t.Helper()
+	n, err := db.Exec(sql)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	return n
+}
+
+func TestDefaults(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `create table t (
+		id int64, price float64 default 0, d decimal default 1, doc json default '{}',
+		primary key (id)
+	)`)
+	mustExec(t, db, `insert into t (id) values (1)`)
+	rec := *(&Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("t", &rec); !ok || err != nil {
+		t.Fatalf("got %v %v", ok, err)
+	}
+	want := []Value{
+		{Type: TYPE_INT64, I64: 1},
+		{Type: TYPE_FLOAT64, F64: 0},
+		{Type: TYPE_DECIMAL, I64: DECIMAL_ONE},
+		{Type: TYPE_JSON, Str: []byte("{}")},
+	}
+	for i, v := range want {
+		if got := rec.Vals[i]; got.Type != v.Type || qlCompare(got, v) != 0 {
+			t.Errorf("%s: got %+v", rec.Cols[i], rec.Vals[i])
+		}
+	}
+
+	// the defaults are checked with the definition
+	for _, sql := range []string{
+		`create table bad (id int64, a int64 default 'x', primary key (id))`,
+		`create table bad (id int64, doc json default '{', primary key (id))`,
+	} {
+		if _, err := db.Exec(sql); err == nil {
+			t.Errorf("%s: no error", sql)
+		}
+	}
+
+	// a column added later ,the default is kept as an expression
+	if err := db.TableAddColumn("t", "tags", TYPE_JSON, Value{Type: TYPE_JSON, Str: []byte("[]")}); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, `insert into t (id) values (2)`)
+	rec = *(&Record{}).AddInt64("id", 2)
+	if ok, err := db.Get("t", &rec); !ok || err != nil || string(rec.Get("tags").Str) != "[]" {
+		t.Fatalf("got %v %v %+v", ok, err, rec)
+	}
+}
+
+func TestCheckConstraint(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `create table t (
+		id int64, a int64 null,
+		primary key (id),
+		constraint positive check (a > 0),
+		constraint number check (a + 1)
+	)`)
+
+	// NULL passes the 1st check ,the 2nd one gives NULL too
+	mustExec(t, db, `insert into t (id) values (1)`)
+	_, err := db.Exec(`insert into t (id, a) values (2, 0)`)
+	cerr := (*ConstraintError)(nil)
+	if !errors.As(err, &cerr) || cerr.Constraint != "check(positive)" {
+		t.Fatalf("got %v", err)
+	}
+	// not a BOOL
+	_, err = db.Exec(`insert into t (id, a) values (3, 1)`)
+	if err == nil || errors.As(err, &cerr) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestAddColumnJSONDefault(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `create table t (id int64, primary key (id))`)
+	mustExec(t, db, `insert into t (id) values (1)`)
+	err := db.TableAddColumn("t", "doc", TYPE_JSON, Value{Type: TYPE_JSON, Str: []byte("{")})
+	if err == nil {
+		t.Fatal("no error")
+	}
+	tx := DBTX{}
+	db.Begin(&tx)
+	defer db.Abort(&tx)
+	if tdef := readTableDef(t, &tx, "t"); len(tdef.Cols) != 1 {
+		t.Fatalf("cols %v", tdef.Cols)
+	}
+}
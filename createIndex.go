@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// CREATE INDEX on a table that already has rows.
+//
+// Building the index in 1 tx would hold a huge tx and conflict with every writer,
+// so it is done in 3 steps :
+// 1. a tx adds the index to the `TableDef` and marks it as `Building`
+//    from now on every write also maintains the new index (see `indexOp()`),
+//    but queries dont use it yet
+// 2. the rows are copied into the index in small txs ,in primary key order
+//    a batch that races with a writer fails with `ErrTxConflict` and is retried
+// 3. a tx clears `Building` ,the index is ready
+// if step 2 fails the index is removed again (see `indexBuildFailed()`)
+
+// rows per backfill tx
+const INDEX_BUILD_BATCH = 1000
+
+// a unique index fails with a `*ConstraintError` if the existing rows have duplicates
+func (db *DB) IndexNew(table string, cols []string, unique bool) error {
+	// 1. add the index
+	tx := DBTX{}
+	db.Begin(&tx)
+	idx, err := indexAdd(&tx, table, cols, unique)
+	if err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	if err := db.Commit(&tx); err != nil {
+		return err
+	}
+
+	// 2. backfill
+	var start []byte // the last row copied
+	for {
+		tx := DBTX{}
+		db.Begin(&tx)
+		next, err := indexBackfill(&tx, table, idx, start)
+		if err != nil {
+			db.Abort(&tx)
+			return indexBuildFailed(db, table, idx, err)
+		}
+		err = db.Commit(&tx)
+		if errors.Is(err, ErrTxConflict) {
+			continue // retry the batch
+		}
+		if err != nil {
+			return indexBuildFailed(db, table, idx, err)
+		}
+		if next == nil {
+			break // no more rows
+		}
+		start = next
+	}
+
+	// 3. done
+	tx = DBTX{}
+	db.Begin(&tx)
+	tdef, err := buildingIndex(&tx, table, idx)
+	if err == nil {
+		tdef = cloneTableDef(tdef)
+		tdef.Building = 0
+		err = saveTableDef(&tx, tdef)
+	}
+	if err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+// remove the index after a failed backfill (eg duplicates for a unique index),
+// so the table isnt left with a half built index
+// returns the error of the backfill
+func indexBuildFailed(db *DB, table string, idx int, cause error) error {
+	for {
+		tx := DBTX{}
+		db.Begin(&tx)
+		if _, err := buildingIndex(&tx, table, idx); err != nil {
+			db.Abort(&tx)
+			return cause // dropped already
+		}
+		tdef, err := alterTableDef(&tx, table)
+		prefix := uint32(0)
+		if err == nil {
+			prefix = tdef.Prefixes[idx]
+			err = indexRemove(&tx, tdef, idx)
+		}
+		if err != nil {
+			db.Abort(&tx)
+			return fmt.Errorf("%w (removing the index: %v)", cause, err)
+		}
+		err = db.Commit(&tx)
+		if errors.Is(err, ErrTxConflict) {
+			continue
+		}
+		if err == nil {
+			err = dropKeyPrefix(db, prefix)
+		}
+		if err != nil {
+			return fmt.Errorf("%w (removing the index: %v)", cause, err)
+		}
+		return cause
+	}
+}
+
+// returns the position of the new index
+func indexAdd(tx *DBTX, table string, cols []string, unique bool) (int, error) {
+	tdef, err := alterTableDef(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	if tdef.Building != 0 {
+		return 0, fmt.Errorf("table %s: another index is being built", table)
+	}
+	index, err := checkIndexKeys(tdef, cols, unique)
+	if err != nil {
+		return 0, err
+	}
+	for i, other := range tdef.Indexes {
+		if slices.Equal(other, index) && isUnique(tdef, i) == unique {
+			return 0, fmt.Errorf("table %s: index exists: %v", table, cols)
+		}
+	}
+	prefix, err := allocPrefixes(tx, 1)
+	if err != nil {
+		return 0, err
+	}
+	for len(tdef.Unique) < len(tdef.Indexes) {
+		tdef.Unique = append(tdef.Unique, false) // from before unique indexes
+	}
+	tdef.Indexes = append(tdef.Indexes, index)
+	tdef.Unique = append(tdef.Unique, unique)
+	tdef.Prefixes = append(tdef.Prefixes, prefix)
+	tdef.Building = len(tdef.Indexes) - 1
+	return tdef.Building, saveTableDef(tx, tdef)
+}
+
+// the table ,if the index is still being built
+func buildingIndex(tx *DBTX, table string, idx int) (*TableDef, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	if tdef == nil || tdef.Building != idx {
+		// dropped while we were building it
+		return nil, fmt.Errorf("table %s: index build was interrupted", table)
+	}
+	return tdef, nil
+}
+
+// copy up to `INDEX_BUILD_BATCH` rows after `start` into the index
+// returns the last row copied ,or nil at the end of the table
+func indexBackfill(tx *DBTX, table string, idx int, start []byte) ([]byte, error) {
+	tdef, err := buildingIndex(tx, table, idx)
+	if err != nil {
+		return nil, err
+	}
+	prefix := encodeKey(nil, tdef.Prefixes[0], nil)
+	cmp := CMP_GT
+	if start == nil {
+		start, cmp = prefix, CMP_GE
+	}
+
+	keys, rows := [][]byte(nil), [][]Value(nil)
+	for iter := tx.kv.Seek(start, cmp); iter.Valid() && len(keys) < INDEX_BUILD_BATCH; iter.Next() {
+		key, val := iter.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		pkey := make([]Value, tdef.Pkeys)
+		for i := range pkey {
+			pkey[i].Type = tdef.Types[i]
+		}
+		decodeKey(key, pkey)
+		keys = append(keys, append([]byte(nil), key...))
+		rows = append(rows, decodeRow(tdef, pkey, val))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	// the scanned range is recorded by the iterator ,see `CombinedIter.track()`
+
+	// only add the key for the new index
+	only := *tdef
+	only.Indexes = [][]string{tdef.Indexes[0], tdef.Indexes[idx]}
+	only.Prefixes = []uint32{tdef.Prefixes[0], tdef.Prefixes[idx]}
+	only.Unique = []bool{false, isUnique(tdef, idx)}
+	only.Building = 1
+	for _, row := range rows {
+		if err := checkUnique(tx, &only, row); err != nil {
+			return nil, err
+		}
+		indexOp(tx, &only, row, INDEX_ADD)
+	}
+	return keys[len(keys)-1], nil
+}
+
+// DROP INDEX : remove the index and its keys
+// the keys are deleted in small txs after the index is removed ,like `DB.TableDrop()`
+func (db *DB) IndexDrop(table string, cols []string, unique bool) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	prefix, err := indexDrop(&tx, table, cols, unique)
+	if err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	if err := db.Commit(&tx); err != nil {
+		return err
+	}
+	return dropKeyPrefix(db, prefix)
+}
+
+// like `DB.IndexDrop()` ,but the keys are deleted in this tx
+func (tx *DBTX) IndexDrop(table string, cols []string, unique bool) error {
+	prefix, err := indexDrop(tx, table, cols, unique)
+	if err == nil {
+		deleteKeyPrefix(tx, prefix)
+	}
+	return err
+}
+
+// remove the index from the table ,returns the prefix of its keys
+func indexDrop(tx *DBTX, table string, cols []string, unique bool) (uint32, error) {
+	tdef, err := alterTableDef(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	index, err := checkIndexKeys(tdef, cols, unique)
+	if err != nil {
+		return 0, err
+	}
+	idx := -1
+	for i, other := range tdef.Indexes {
+		if slices.Equal(other, index) && isUnique(tdef, i) == unique {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return 0, fmt.Errorf("table %s: index not found: %v", table, cols)
+	}
+	if idx == 0 {
+		return 0, fmt.Errorf("table %s: cannot drop the primary key", table)
+	}
+	prefix := tdef.Prefixes[idx]
+	return prefix, indexRemove(tx, tdef, idx)
+}
+
+// remove the index from `tdef` (a copy from `alterTableDef()`) ,the caller deletes its keys
+func indexRemove(tx *DBTX, tdef *TableDef, idx int) error {
+	tdef.Indexes = slices.Delete(tdef.Indexes, idx, idx+1)
+	tdef.Prefixes = slices.Delete(tdef.Prefixes, idx, idx+1)
+	if idx < len(tdef.Unique) {
+		tdef.Unique = slices.Delete(tdef.Unique, idx, idx+1)
+	}
+	switch {
+	case tdef.Building == idx:
+		tdef.Building = 0 // the build stops at its next batch
+	case tdef.Building > idx:
+		tdef.Building--
+	}
+	return saveTableDef(tx, tdef)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Multiple processes can map the same file with MAP_SHARED,
+// but only one of them may update it, otherwise two writers would race on
+// `updateRoot` and overwrite each other's meta page (and pages from the free list).
+//
+// We use 2 advisory locks (flock) :
+// 1. writer lock : an exclusive lock on a side file `<path>.lock`
+//    only 1 process can hold it, a 2nd writer gets `ErrLocked`
+//    it is taken before the database file is opened ,so only the writer creates a new file
+// 2. reader lock : a shared lock on the database file itself
+//    every process that has the file open holds it (writers too)
+//    so a tool that wants the file all to itself can take it exclusively
+//
+// readers never touch the lock file, so they work next to a live writer
+// and pick up the roots it commits with `Refresh()`
+
+var ErrLocked = errors.New("database is locked")
+var ErrReadOnly = errors.New("database is opened read-only")
+
+// suffix of the side file that holds the writer lock
+const LOCK_FILE_SUFFIX = ".lock"
+
+// take the writer lock ; called by `Open()` before the db file is opened ,
+// so a new file is only created by the process that holds the lock
+func lockWriter(db *KV) error {
+	db.lockFd = -1
+	if db.Options.ReadOnly {
+		return nil // readers dont need the writer lock
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	fd, err := syscall.Open(db.Path+LOCK_FILE_SUFFIX, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("open lock file: %w", err)
+	}
+	// LOCK_NB = dont wait for the lock ,fail right away
+	if err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		syscall.Close(fd)
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return ErrLocked // another writer has the database open
+		}
+		return fmt.Errorf("flock: %w", err)
+	}
+	db.lockFd = fd
+	return nil
+}
+
+// take the reader lock on the opened db file ; called by `Open()`
+func lockReader(db *KV) error {
+	if err := unix.Flock(db.fd, unix.LOCK_SH|unix.LOCK_NB); err != nil {
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return ErrLocked // someone owns the file exclusively
+		}
+		return fmt.Errorf("flock: %w", err)
+	}
+	return nil
+}
+
+// release the locks ,closing the fd also drops the flock
+// but we do it explicitly to not depend on it
+func unlockDB(db *KV) {
+	if db.lockFd >= 0 {
+		unix.Flock(db.lockFd, unix.LOCK_UN)
+		syscall.Close(db.lockFd)
+		db.lockFd = -1
+	}
+	if db.fd >= 0 {
+		unix.Flock(db.fd, unix.LOCK_UN)
+	}
+}
+
+// refuse updates from a reader or after `Close()`
+func checkWritable(db *KV) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Refresh reloads the meta page written by the writer process
+// so that a reader sees the latest committed root.
+// The meta page is written with a single small `pwrite` ,so we
+// either read the old one or the new one, never half of each.
+func (db *KV) Refresh() error {
+	if !db.Options.ReadOnly {
+		return nil // the writer always has the latest root
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// the file may have grown since we mapped it
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(db.fd, &stat); err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	if err := extendedMmap(db, int(stat.Size)); err != nil {
+		return err
+	}
+
+	// read the meta page with a syscall ,not from the mmap ,to get
+	// the current copy from the page cache
+	var data [META_SIZE]byte
+	if _, err := syscall.Pread(db.fd, data[:], 0); err != nil {
+		return fmt.Errorf("read meta page: %w", err)
+	}
+	if _, _, _, err := decodeMeta(data[:]); err != nil {
+		return err
+	}
+	loadMeta(db, data[:])
+	return nil
+}
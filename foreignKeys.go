@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Foreign keys : columns of a table (the child) that reference the primary key
+// of another table (the parent).
+//
+// Inserting or updating a child row checks that the parent row exists ,with a point
+// lookup (see `checkParentRows()`). A NULL in the columns skips the check.
+// Deleting a parent row looks up the child rows through an index on the foreign key
+// columns ,one is added to the child table if none covers them ,then :
+//   - FK_RESTRICT : fail if there are any
+//   - FK_CASCADE  : delete them too (and their children)
+//   - FK_SET_NULL : set the columns to NULL ,they must be nullable
+// The primary key of a row never changes (an update with a new key is a new row),
+// so updating a parent row doesnt affect the children.
+//
+// The parent keeps the names of its children in `TableDef.RefBy` ,so a delete
+// doesnt have to look at every table. A violation is a `*ConstraintError`.
+// Deleting with cascades may already have written some rows when it fails ,abort the tx.
+
+const (
+	FK_RESTRICT = 0
+	FK_CASCADE  = 1
+	FK_SET_NULL = 2
+)
+
+type ForeignKey struct {
+	Cols     []string // in the order of the parent's primary key
+	Table    string   // the parent
+	OnDelete int      // FK_RESTRICT ,FK_CASCADE or FK_SET_NULL
+}
+
+// eg `foreign key(order_id) references orders`
+func foreignKeyName(fk ForeignKey) string {
+	return fmt.Sprintf("foreign key(%s) references %s", strings.Join(fk.Cols, ","), fk.Table)
+}
+
+// the checks that dont need the parent ,called by `tableDefCheck()` after the indexes
+func foreignKeyDefCheck(tdef *TableDef) error {
+	if len(tdef.RefBy) != 0 {
+		return fmt.Errorf("table %s: references are maintained by the db", tdef.Name)
+	}
+	for _, fk := range tdef.ForeignKeys {
+		if len(fk.Cols) == 0 || fk.Table == "" {
+			return fmt.Errorf("table %s: empty foreign key", tdef.Name)
+		}
+		for i, col := range fk.Cols {
+			idx := slices.Index(tdef.Cols, col)
+			if idx < 0 {
+				return fmt.Errorf("table %s: foreign key: unknown column: %s", tdef.Name, col)
+			}
+			if slices.Contains(fk.Cols[:i], col) {
+				return fmt.Errorf("table %s: foreign key: duplicate column: %s", tdef.Name, col)
+			}
+			if fk.OnDelete == FK_SET_NULL && !isNullable(tdef, idx) {
+				return fmt.Errorf("table %s: foreign key: SET NULL on a non nullable column: %s", tdef.Name, col)
+			}
+		}
+		if fk.OnDelete < FK_RESTRICT || fk.OnDelete > FK_SET_NULL {
+			return fmt.Errorf("table %s: foreign key: bad ON DELETE action: %d", tdef.Name, fk.OnDelete)
+		}
+
+		// an index to find the child rows
+		if foreignKeyIndex(tdef, fk) < 0 {
+			index, err := checkIndexKeys(tdef, fk.Cols, false)
+			if err != nil {
+				return err
+			}
+			tdef.Indexes = append(tdef.Indexes, index)
+			tdef.Unique = append(tdef.Unique, false)
+		}
+	}
+	return nil
+}
+
+// the index that starts with the columns ,-1 if none
+func foreignKeyIndex(tdef *TableDef, fk ForeignKey) int {
+	for i, index := range tdef.Indexes {
+		if len(index) >= len(fk.Cols) && slices.Equal(index[:len(fk.Cols)], fk.Cols) {
+			return i
+		}
+	}
+	return -1
+}
+
+// check the parents of a new table and add it to their `RefBy`
+func foreignKeyLink(tx *DBTX, tdef *TableDef) error {
+	for _, fk := range tdef.ForeignKeys {
+		parent := tdef // references itself
+		if fk.Table != tdef.Name {
+			var err error
+			if parent, err = alterTableDef(tx, fk.Table); err != nil {
+				return fmt.Errorf("table %s: foreign key: %w", tdef.Name, err)
+			}
+		}
+		if len(fk.Cols) != parent.Pkeys {
+			return fmt.Errorf("table %s: %s: the parent has %d primary key columns",
+				tdef.Name, foreignKeyName(fk), parent.Pkeys)
+		}
+		for i, col := range fk.Cols {
+			if tdef.Types[slices.Index(tdef.Cols, col)] != parent.Types[i] {
+				return fmt.Errorf("table %s: %s: type mismatch: %s", tdef.Name, foreignKeyName(fk), col)
+			}
+		}
+		if slices.Contains(parent.RefBy, tdef.Name) {
+			continue // 2 foreign keys to the same table
+		}
+		parent.RefBy = append(parent.RefBy, tdef.Name)
+		if parent != tdef {
+			if err := saveTableDef(tx, parent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// remove a dropped table from the `RefBy` of its parents
+func foreignKeyUnlink(tx *DBTX, tdef *TableDef) error {
+	for _, child := range tdef.RefBy {
+		if child != tdef.Name {
+			return fmt.Errorf("table %s is referenced by %s", tdef.Name, child)
+		}
+	}
+	for _, fk := range tdef.ForeignKeys {
+		if fk.Table == tdef.Name {
+			continue
+		}
+		parent, err := alterTableDef(tx, fk.Table)
+		if err != nil {
+			return err
+		}
+		if idx := slices.Index(parent.RefBy, tdef.Name); idx >= 0 {
+			parent.RefBy = slices.Delete(parent.RefBy, idx, idx+1)
+			if err := saveTableDef(tx, parent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the parent rows of a child row must exist ,`vals` is the full row in table order
+func checkParentRows(tx *DBTX, tdef *TableDef, vals []Value) error {
+	for _, fk := range tdef.ForeignKeys {
+		parent, err := findTableDef(tx, fk.Table)
+		if err != nil {
+			return err
+		}
+		key := Record{}
+		for i, col := range fk.Cols {
+			key.Cols = append(key.Cols, parent.Cols[i])
+			key.Vals = append(key.Vals, vals[slices.Index(tdef.Cols, col)])
+		}
+		if slices.ContainsFunc(key.Vals, func(v Value) bool { return v.Type == TYPE_NULL }) {
+			continue
+		}
+		ok, err := dbGet(tx, parent, &key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &ConstraintError{
+				Table:      tdef.Name,
+				Constraint: foreignKeyName(fk),
+				Msg:        "no matching row in " + fk.Table,
+			}
+		}
+	}
+	return nil
+}
+
+// delete a row and apply the ON DELETE actions to its children
+func fkDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
+	if len(tdef.RefBy) == 0 {
+		return dbDelete(tx, tdef, rec)
+	}
+	pkey, err := checkRecord(tdef, rec, tdef.Pkeys)
+	if err != nil {
+		return false, err
+	}
+	pkey = pkey[:tdef.Pkeys]
+
+	type childRows struct {
+		tdef *TableDef
+		fk   ForeignKey
+		rows []Record
+	}
+	children := []childRows(nil)
+	for _, name := range tdef.RefBy {
+		child, err := findTableDef(tx, name)
+		if err != nil {
+			return false, err
+		}
+		for _, fk := range child.ForeignKeys {
+			if fk.Table != tdef.Name {
+				continue
+			}
+			rows, err := childRowsOf(tx, child, fk, pkey)
+			if err != nil {
+				return false, err
+			}
+			if len(rows) == 0 {
+				continue
+			}
+			if fk.OnDelete == FK_RESTRICT {
+				return false, &ConstraintError{
+					Table:      child.Name,
+					Constraint: foreignKeyName(fk),
+					Msg:        "the row is referenced",
+				}
+			}
+			children = append(children, childRows{child, fk, rows})
+		}
+	}
+
+	deleted, err := dbDelete(tx, tdef, rec)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	for _, c := range children {
+		for _, row := range c.rows {
+			switch c.fk.OnDelete {
+			case FK_CASCADE:
+				key := Record{Cols: row.Cols[:c.tdef.Pkeys], Vals: row.Vals[:c.tdef.Pkeys]}
+				_, err = fkDelete(tx, c.tdef, key)
+			case FK_SET_NULL:
+				for _, col := range c.fk.Cols {
+					row.Vals[slices.Index(row.Cols, col)] = Value{Type: TYPE_NULL}
+				}
+				_, err = dbUpdate(tx, c.tdef, row, MODE_UPDATE_ONLY)
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// the child rows that reference the primary key ,read in full before anything is changed
+func childRowsOf(tx *DBTX, child *TableDef, fk ForeignKey, pkey []Value) ([]Record, error) {
+	key := Record{Cols: fk.Cols, Vals: pkey}
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+	if err := dbScan(tx, child, &sc); err != nil {
+		return nil, err
+	}
+	rows := []Record(nil)
+	for ; sc.Valid(); sc.Next() {
+		row := Record{}
+		if err := sc.deref(&row); err != nil {
+			return nil, err
+		}
+		row.Vals = slices.Clone(row.Vals)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -1,5 +1,7 @@
 package main
 
+import "encoding/binary"
+
 // Data is stored in pages, which are linked together.
 // When a page is deleted, it is not removed but added to a free list.
 // The free list is a separate structure that tracks reusable pages.
@@ -13,18 +15,45 @@ type LNode []byte
 // header of LNode
 const FREE_LIST_HEADER = 8
 
-// how many uint64 can be stored
+// how many items can be stored
+// each item is a pair of uint64 : the page pointer and the version that freed it
 // eg 4096 (size of a node of Btree)
-// 4096-8/8 = 511 uint64
-const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+// 4096-8/16 = 255 items
+const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 16
 
-func (node LNode) getNext() uint64
-func (node LNode) setNext(next uint64)
-func (node LNode) getPtr(index int) uint64
+// | next | pointer-version pairs |
+// | 8B   | n*16B                 |
+
+func (node LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[0:8])
+}
+func (node LNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[0:8], next)
+}
+func (node LNode) getPtr(index int) uint64 {
+	offset := FREE_LIST_HEADER + 16*index
+	return binary.LittleEndian.Uint64(node[offset:])
+}
 
 // ptr here isnt pointer to memory as we arent storing data in memory but in disk
 // so its a pointer in form of numbers
-func (node LNode) setPtr(index int, ptr uint64)
+func (node LNode) setPtr(index int, ptr uint64) {
+	assert(index < FREE_LIST_CAP)
+	offset := FREE_LIST_HEADER + 16*index
+	binary.LittleEndian.PutUint64(node[offset:], ptr)
+}
+
+// version of the tx that freed the page at `index`
+// a snapshot older than it may still read the page
+func (node LNode) getVer(index int) uint64 {
+	offset := FREE_LIST_HEADER + 16*index + 8
+	return binary.LittleEndian.Uint64(node[offset:])
+}
+func (node LNode) setVer(index int, ver uint64) {
+	assert(index < FREE_LIST_CAP)
+	offset := FREE_LIST_HEADER + 16*index + 8
+	binary.LittleEndian.PutUint64(node[offset:], ver)
+}
 
 type FreeList struct {
 	// callbacks for managing on disk-pages
@@ -91,7 +120,12 @@ func flPop(fl *FreeList) (ptr uint64, head uint64) {
 		return 0, 0 // no more free items
 	}
 	node := LNode(fl.get(fl.headPage)) // get the current node
-	ptr = node.getPtr(seq2idx(fl.headPage)) // get the item ,item from the node
+	// the page was freed by a tx newer than the oldest reader ,a snapshot may still
+	// be reading it ,so stop here. items are in version order so the rest is newer too
+	if !versionBefore(node.getVer(seq2idx(fl.headSeq)), fl.maxVer) {
+		return 0, 0
+	}
+	ptr = node.getPtr(seq2idx(fl.headSeq)) // get the item ,item from the node
 	fl.headSeq++                            // increment head seq to move to next item
 
 	// mIf we used up all items in this node, move to the next one
@@ -115,12 +149,19 @@ func (fl *FreeList) PopHead()uint64{
 }
 
 func (fl *FreeList) PushTail(ptr uint64){
-	
+	// the list is not stored in the meta page ,it starts empty on each open
+	// and its 1st node is allocated here (the list is never empty after that)
+	if fl.tailPage == 0 {
+		fl.tailPage = fl.new(make([]byte, BTREE_PAGE_SIZE))
+		fl.headPage = fl.tailPage
+	}
+
 	// add it to the tail node
 	// fl.set = set a new page
 	// set the pointer of tail node 
 	// seq2idx = ccalculates the index of an item within a specific LNode, not the index of the node itself in the free list.
 	LNode(fl.set(fl.tailPage)).setPtr(seq2idx(fl.tailSeq),ptr)
+	LNode(fl.set(fl.tailPage)).setVer(seq2idx(fl.tailSeq),fl.curVer)
 	fl.tailSeq++;
 	
 	//add a new tail node if its full(list is neevr empty)
@@ -140,6 +181,7 @@ func (fl *FreeList) PushTail(ptr uint64){
 		// also add the head node if its removed
 		if head!=0{
 			LNode(fl.set(fl.tailPage)).setPtr(0,head)
+			LNode(fl.set(fl.tailPage)).setVer(0,fl.curVer)
 			fl.tailSeq++
 		}
 	}
@@ -4,4 +4,4 @@ go 1.23.0
 
 toolchain go1.23.7
 
-require golang.org/x/sys v0.31.0 // indirect
+require golang.org/x/sys v0.31.0
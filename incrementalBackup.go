@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Incremental backup : only the pages written since a previous backup.
+//
+// Every page write is tagged with `KV.version` (see `markPageWritten()`) ,
+// both appended pages and pages reused from the free list.
+// Because of copy-on-write ,updating a key rewrites the whole path from the leaf to the root,
+// so if a node was not written since the last backup then nothing below it was either,
+// and we can skip the whole subtree.
+//
+// The tags are only kept in memory ,so an increment can only be taken
+// from a version after the database was opened ,otherwise take a full backup.
+//
+// Format of an increment :
+// | magic | since | version | root | pages | records... | 0 |
+// |  8B   |  8B   |   8B    |  8B  |  8B   |            | 8B|
+// record :
+// | ptr | page |
+// | 8B  | 4KB  |
+// the list of records ends with ptr = 0 (page 0 is the meta page ,it is never a record)
+
+const INCR_SIG = "KVINCR01"
+
+var ErrIncrementalTooOld = errors.New("incremental backup: version is older than the page tracking ,take a full backup")
+
+// tag a page with the version that wrote it
+// every path that writes a page to the file must call this
+func markPageWritten(db *KV, ptr uint64) {
+	if db.page.written != nil {
+		db.page.written[ptr] = db.version
+	}
+}
+
+// read the version of a full backup ,pass it to `BackupIncremental()`
+func BackupVersion(r io.ReaderAt) (uint64, error) {
+	var data [META_SIZE]byte
+	if _, err := r.ReadAt(data[:], 0); err != nil {
+		return 0, fmt.Errorf("read meta page: %w", err)
+	}
+	_, _, version, err := decodeMeta(data[:])
+	return version, err
+}
+
+// write the pages changed since the backup at version `since`
+// returns the version of the increment ,to be used as `since` for the next one
+func (kv *KV) BackupIncremental(w io.Writer, since uint64) (uint64, error) {
+	snap, err := kv.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Close()
+
+	// copy the tags we need ,writers keep adding to the map
+	kv.mutex.Lock()
+	if versionBefore(since, kv.page.trackedSince) || versionBefore(snap.version, since) {
+		kv.mutex.Unlock()
+		return 0, ErrIncrementalTooOld
+	}
+	written := map[uint64]uint64{}
+	for ptr, ver := range kv.page.written {
+		if !versionBefore(ver, since) && ptr < snap.pages {
+			written[ptr] = ver
+		}
+	}
+	kv.mutex.Unlock()
+
+	var hdr [40]byte
+	copy(hdr[:8], []byte(INCR_SIG))
+	binary.LittleEndian.PutUint64(hdr[8:], since)
+	binary.LittleEndian.PutUint64(hdr[16:], snap.version)
+	binary.LittleEndian.PutUint64(hdr[24:], snap.tree.root)
+	binary.LittleEndian.PutUint64(hdr[32:], snap.pages)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	if snap.tree.root != 0 {
+		if err := copyChangedPages(&snap.tree, snap.tree.root, written, w); err != nil {
+			return 0, err
+		}
+	}
+	var end [8]byte // ptr = 0
+	if _, err := w.Write(end[:]); err != nil {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	return snap.version, nil
+}
+
+func copyChangedPages(tree *BTree, ptr uint64, written map[uint64]uint64, w io.Writer) error {
+	if _, ok := written[ptr]; !ok {
+		return nil // not written since the last backup ,and so is the subtree
+	}
+	node := BNode(tree.get(ptr))
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], ptr)
+	if _, err := w.Write(buf[:]); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if _, err := w.Write(node); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := copyChangedPages(tree, node.getPtr(i), written, w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Restore a database into `file` from a full (non compact) backup and a chain
+// of increments ,in the order they were taken.
+// The result is checked before it is renamed to `file`.
+func RestoreBackup(file string, base io.Reader, incs ...io.Reader) error {
+	tmp := file + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	defer fp.Close()
+
+	err = restoreInto(fp, base, incs)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(file)
+}
+
+func restoreInto(fp *os.File, base io.Reader, incs []io.Reader) error {
+	if _, err := io.Copy(fp, base); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	version, err := BackupVersion(fp)
+	if err != nil {
+		return err
+	}
+	if len(incs) > 0 {
+		// the page numbers of a compact backup dont match the increments
+		mark := make([]byte, len(BACKUP_COMPACT_MARK))
+		if _, err := fp.ReadAt(mark, META_SIZE); err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		if string(mark) == BACKUP_COMPACT_MARK {
+			return errors.New("restore: a compact backup cannot be the base of increments ,use a full backup")
+		}
+	}
+
+	for i, r := range incs {
+		var hdr [40]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return fmt.Errorf("restore: increment %d: %w", i, err)
+		}
+		if string(hdr[:8]) != INCR_SIG {
+			return fmt.Errorf("restore: increment %d: bad signature", i)
+		}
+		since := binary.LittleEndian.Uint64(hdr[8:])
+		newVer := binary.LittleEndian.Uint64(hdr[16:])
+		root := binary.LittleEndian.Uint64(hdr[24:])
+		pages := binary.LittleEndian.Uint64(hdr[32:])
+		// the increment must start at or before what we have ,and end after it
+		if versionBefore(version, since) || versionBefore(newVer, version) {
+			return fmt.Errorf("restore: increment %d: broken chain (have %d ,increment is %d..%d)",
+				i, version, since, newVer)
+		}
+
+		page := make([]byte, BTREE_PAGE_SIZE)
+		for {
+			var buf [8]byte
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return fmt.Errorf("restore: increment %d: %w", i, err)
+			}
+			ptr := binary.LittleEndian.Uint64(buf[:])
+			if ptr == 0 {
+				break
+			}
+			if ptr >= pages {
+				return fmt.Errorf("restore: increment %d: bad ptr %d", i, ptr)
+			}
+			if _, err := io.ReadFull(r, page); err != nil {
+				return fmt.Errorf("restore: increment %d: %w", i, err)
+			}
+			if _, err := fp.WriteAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+				return fmt.Errorf("restore: %w", err)
+			}
+		}
+
+		if err := fp.Truncate(int64(pages * BTREE_PAGE_SIZE)); err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		if _, err := fp.WriteAt(encodeMeta(root, pages, newVer), 0); err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		version = newVer
+	}
+	return verifyFile(fp, version)
+}
+
+// check the meta page and that the tree only points to pages inside the file
+func verifyFile(fp *os.File, version uint64) error {
+	var data [META_SIZE]byte
+	if _, err := fp.ReadAt(data[:], 0); err != nil {
+		return fmt.Errorf("verify: read meta page: %w", err)
+	}
+	root, pages, ver, err := decodeMeta(data[:])
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	if ver != version {
+		return fmt.Errorf("verify: version is %d ,expected %d", ver, version)
+	}
+	stat, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	if uint64(stat.Size()) < pages*BTREE_PAGE_SIZE {
+		return fmt.Errorf("verify: file is shorter than %d pages", pages)
+	}
+	if root == 0 {
+		return nil // empty tree
+	}
+	return verifyPage(fp, root, pages)
+}
+
+func verifyPage(fp *os.File, ptr uint64, pages uint64) error {
+	if ptr == 0 || ptr >= pages {
+		return fmt.Errorf("verify: bad ptr %d", ptr)
+	}
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	if _, err := fp.ReadAt(node, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	switch node.btype() {
+	case BNODE_LEAF:
+		return nil
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := verifyPage(fp, node.getPtr(i), pages); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("verify: bad node type at page %d", ptr)
+	}
+}
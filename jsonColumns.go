@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON columns : a TYPE_JSON value is the document text in `Value.Str`.
+// It is checked with `json.Valid()` on insert and stored like TYPE_BYTES ,
+// comparisons are on the bytes.
+//
+// Path extraction :
+//   doc -> 'a'        the value under key `a` ,as JSON
+//   doc -> 0          the 1st item of an array ,as JSON
+//   doc -> 'a' ->> 'b' the value as text : a string is unquoted ,JSON null is NULL
+// A missing key ,an index out of range or a step into a scalar gives NULL.
+//
+// Expression indexes : an index column can be a path over a JSON column ,
+// written like in a query ,eg `payload->'user'->>'id'`.
+// The key is the extracted value ,a `->>` path gives TYPE_BYTES and a `->` path TYPE_JSON ,
+// so a scan on the same text as a column name uses the index (see `dbScan()`).
+// A `->>` key is text even for a JSON number ,so a range scan compares strings :
+// 10 sorts before 9 ,only equality on numbers works as expected.
+
+const JSON_PATH_OP = "->"
+
+// an index column ,either a plain column or a JSON path over one
+type indexExpr struct {
+	Col  string
+	Path []Value // TYPE_BYTES keys or TYPE_INT64 array indexes
+	Text bool    // ends with `->>`
+}
+
+// the column an index column is computed from
+func indexColumn(s string) string {
+	col, _, _ := strings.Cut(s, JSON_PATH_OP)
+	return col
+}
+
+// parse `col->'a'->1->>'b'`
+func parseIndexExpr(s string) (indexExpr, error) {
+	col, rest, ok := strings.Cut(s, JSON_PATH_OP)
+	expr := indexExpr{Col: col}
+	if !ok {
+		return expr, nil
+	}
+	rest = JSON_PATH_OP + rest
+	for rest != "" {
+		if expr.Text {
+			return expr, fmt.Errorf("bad JSON path %q: `->>` must be the last step", s)
+		}
+		if !strings.HasPrefix(rest, JSON_PATH_OP) {
+			return expr, fmt.Errorf("bad JSON path %q", s)
+		}
+		rest = rest[len(JSON_PATH_OP):]
+		if strings.HasPrefix(rest, ">") {
+			expr.Text = true
+			rest = rest[1:]
+		}
+		var step Value
+		if strings.HasPrefix(rest, "'") {
+			end := strings.IndexByte(rest[1:], '\'')
+			if end < 0 {
+				return expr, fmt.Errorf("bad JSON path %q: unterminated key", s)
+			}
+			step = Value{Type: TYPE_BYTES, Str: []byte(rest[1 : 1+end])}
+			rest = rest[2+end:]
+		} else {
+			end := strings.Index(rest, JSON_PATH_OP)
+			if end < 0 {
+				end = len(rest)
+			}
+			i, err := strconv.ParseInt(rest[:end], 10, 64)
+			if err != nil {
+				return expr, fmt.Errorf("bad JSON path %q: bad array index", s)
+			}
+			step = Value{Type: TYPE_INT64, I64: i}
+			rest = rest[end:]
+		}
+		expr.Path = append(expr.Path, step)
+	}
+	return expr, nil
+}
+
+// an index column must be a column ,or a path over a JSON column
+func checkIndexColumn(tdef *TableDef, s string) error {
+	expr, err := parseIndexExpr(s)
+	if err != nil {
+		return fmt.Errorf("table %s: index: %w", tdef.Name, err)
+	}
+	idx := -1
+	for i, col := range tdef.Cols {
+		if col == expr.Col {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("table %s: index: unknown column: %s", tdef.Name, expr.Col)
+	}
+	if len(expr.Path) != 0 && tdef.Types[idx] != TYPE_JSON {
+		return fmt.Errorf("table %s: index: %s is not a JSON column", tdef.Name, expr.Col)
+	}
+	return nil
+}
+
+// the value of an index column for a row ,`vals` is the full row in table order
+func indexValue(tdef *TableDef, s string, vals []Value) Value {
+	expr, err := parseIndexExpr(s)
+	assert(err == nil) // checked by `checkIndexColumn()`
+	for i, col := range tdef.Cols {
+		if col != expr.Col {
+			continue
+		}
+		if len(expr.Path) == 0 || vals[i].Type == TYPE_NULL {
+			return vals[i]
+		}
+		v, err := jsonPath(vals[i], expr.Path, expr.Text)
+		assert(err == nil) // the document was checked on insert
+		return v
+	}
+	panic("unreachable")
+}
+
+// follow the path from a JSON value
+// the result is TYPE_JSON ,or with `text` TYPE_BYTES ,or NULL if not found
+func jsonPath(doc Value, path []Value, text bool) (Value, error) {
+	raw := json.RawMessage(doc.Str)
+	for _, step := range path {
+		next, ok, err := jsonStep(raw, step)
+		if err != nil {
+			return Value{}, err
+		}
+		if !ok {
+			return Value{Type: TYPE_NULL}, nil
+		}
+		raw = next
+	}
+	// compact it ,so the same value always has the same bytes
+	buf := bytes.Buffer{}
+	if err := json.Compact(&buf, raw); err != nil {
+		return Value{}, fmt.Errorf("JSON: %w", err)
+	}
+	raw = buf.Bytes()
+	if !text {
+		return Value{Type: TYPE_JSON, Str: raw}, nil
+	}
+	switch raw[0] {
+	case 'n': // null
+		return Value{Type: TYPE_NULL}, nil
+	case '"':
+		str := ""
+		if err := json.Unmarshal(raw, &str); err != nil {
+			return Value{}, fmt.Errorf("JSON: %w", err)
+		}
+		return Value{Type: TYPE_BYTES, Str: []byte(str)}, nil
+	default: // numbers ,booleans ,objects and arrays as they are written
+		return Value{Type: TYPE_BYTES, Str: raw}, nil
+	}
+}
+
+// 1 step : a key of an object or an index of an array
+func jsonStep(raw json.RawMessage, step Value) (json.RawMessage, bool, error) {
+	switch step.Type {
+	case TYPE_BYTES:
+		obj := map[string]json.RawMessage{}
+		if json.Unmarshal(raw, &obj) != nil {
+			return nil, false, nil // not an object
+		}
+		v, ok := obj[string(step.Str)]
+		return v, ok, nil
+	case TYPE_INT64:
+		arr := []json.RawMessage{}
+		if json.Unmarshal(raw, &arr) != nil {
+			return nil, false, nil // not an array
+		}
+		if step.I64 < 0 || step.I64 >= int64(len(arr)) {
+			return nil, false, nil
+		}
+		return arr[step.I64], true, nil
+	default:
+		return nil, false, fmt.Errorf("JSON path: the key must be a string or an integer")
+	}
+}
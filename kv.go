@@ -2,43 +2,80 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log"
 	"sync"
 
 	"os"
 	"path"
+	"strings"
 	"syscall"
 
-	"firebase.google.com/go/db"
 	"golang.org/x/sys/unix"
 )
 
-const DB_SIG = "BuildYourOwnDB06" // db signature 
+const DB_SIG = "BuildYourOwnDB07" // db signature 
+// 07 : the free list stores a version with each page
+
+// files written before the last format change ,see `decodeMeta()`
+const DB_SIG_PREFIX = "BuildYourOwnDB"
 // -------DB METADATA----------------
-// | sig | root_ptr | page_used |
-// | 16B | 8B | 8B |
+// | sig | root_ptr | page_used | version |
+// | 16B | 8B | 8B | 8B |
+
+const META_SIZE = 40
+
+
+
+// settings for `KV.Open()` ,the zero value is the default
+type Options struct {
+	PageSize int // must be 0 or BTREE_PAGE_SIZE ,the node layout is fixed at compile time
+	Sync     int // SYNC_FULL or SYNC_NONE
+	MmapSize int // size of the 1st mmap chunk in bytes ,default 64MB
+	ReadOnly bool // shared reader ,never takes the writer lock and refuses updates
+	Logger   *log.Logger // nil = no logs
+	FeedSize int // number of committed txs kept for the change feed ,default 1024
+}
+
+const (
+	SYNC_FULL = 0 // fsync before and after the meta page is written
+	SYNC_NONE = 1 // leave it to the OS ,a crash can lose or corrupt recent updates
+)
 
+const DEFAULT_MMAP_SIZE = 64 << 20 // 64MB
+const DEFAULT_FEED_SIZE = 1024
 
+var ErrClosed = errors.New("database is closed")
 
 type KV struct {
-	Path string // file name
+	Path    string // file name
+	Options Options
 
 	// internals
 	fd   int // file descriptor
+	lockFd int // fd of the `<path>.lock` file holding the writer lock
+	closed bool // set by `Close()`
 	tree BTree
 	mmap struct {
 		total int // mmap can be larger than page size
-		chunks [][] //multiple mmap ,can be non-contagious
+		chunks [][]byte //multiple mmap ,can be non-contagious
 	}
 	page struct {
 		flushed uint64 // database size in number of pages
 		temp [][]byte // newly allocated pages
+		updates map[uint64][]byte // pages reused from the free list ,written in place
+		// page number -> KV.version when it was last written ,used by incremental backups
+		// only in memory ,pages written before `trackedSince` are unknown
+		written      map[uint64]uint64
+		trackedSince uint64
 	}
 	failed bool // did the last update fail?
 	free FreeList 
 	version uint64 // monotonic version number; persisted in the meta page,global version counter
 	ongoing []uint64 // version numbers of concurrent TXs , 
-	history [] ComittedTX // change keys, for detecting conflicts // recent commited transaction
+	history []CommittedTX // change keys, for detecting conflicts // recent commited transaction
+	feed ChangeFeed // committed changes for subscribers ,see changeFeed.go
 	mutex sync.Mutex // serialization tx methods, serialization means a resource should be modified by a single thread
 }
 
@@ -47,21 +84,23 @@ type CommittedTX struct {
 	writes []KeyRange // in sorted order
 }
 
-
-func (db *KV) Open() error
 func (db *KV) Get(key []byte) ([]byte, error) {
-	return db.tree.Get(uint64(key[0])), nil
-}
-
-func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return updateFile(db)
+	if db.closed {
+		return nil, ErrClosed
+	}
+	val, _ := db.tree.Get(key)
+	return val, nil
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted :=
-		db.tree.Delete(key)
-	return deleted, updateFile(db)
+	if err := checkWritable(db); err != nil {
+		return false, err
+	}
+	meta := saveMeta(db)
+	if !db.tree.Delete(key) {
+		return false, nil
+	}
+	return true, updateOrRevert(db, meta)
 }
 
 func updateFile(db *KV) error {
@@ -71,7 +110,7 @@ func updateFile(db *KV) error {
 	}
 
 	// 2. `Fsync` to enforce the order between 1 and 3
-	if err := syscall.Fsync(db.fd); err !=nil{
+	if err := syncFile(db); err !=nil{
 		return err
 	}
 
@@ -81,7 +120,17 @@ func updateFile(db *KV) error {
 	}
 
 	// 4. `Fsync` to make everything persistent
-	return syscall.Fsync(db.fd)
+	return syncFile(db)
+}
+
+func syncFile(db *KV) error {
+	if db.Options.Sync == SYNC_NONE {
+		return nil
+	}
+	if err := syscall.Fsync(db.fd); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
 }
 
 
@@ -110,39 +159,219 @@ func createFileSync(file string) (int, error) {
     return fd, nil
 }
 
+// open the db file for reading only
+// no O_CREATE and no directory fsync ,both need write permission,
+// so this works for files on a read-only filesystem too
+func openFileReadOnly(file string) (int, error) {
+	fd, err := syscall.Open(file, os.O_RDONLY, 0)
+	if err != nil {
+		return -1, fmt.Errorf("open file: %w", err)
+	}
+	return fd, nil
+}
 
-// saving pages into disk ,swapping them into ram when required
-func Mmap(fd int,offset int64,length int)(data []byte,err error)
+func openFile(db *KV) (int, error) {
+	if db.Options.ReadOnly {
+		return openFileReadOnly(db.Path)
+	}
+	if _, err := os.Stat(db.Path); errors.Is(err, os.ErrNotExist) {
+		if err := initFileSync(db.Path); err != nil {
+			return -1, err
+		}
+	}
+	return createFileSync(db.Path)
+}
 
+// create a new db file with an initialized meta page
+// the file is prepared under a temp name and then renamed ,so a crash
+// never leaves an empty or half written file under the real name.
+// called with the writer lock held ,the temp name is unique anyway
+// so a leftover from a crash is never reused
+func initFileSync(file string) error {
+	f, err := os.CreateTemp(path.Dir(file), path.Base(file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op after the rename
+	defer f.Close()
+
+	// an empty tree: root = 0 ,only the meta page is used
+	page := make([]byte, BTREE_PAGE_SIZE)
+	copy(page, encodeMeta(0, 1, 0))
+	if _, err := f.WriteAt(page, 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	// persist the rename
+	return syncDir(file)
+}
+
+// fsync the directory of `file` ,to persist a create or a rename
+func syncDir(file string) error {
+	dirfd, err := syscall.Open(path.Dir(file), os.O_RDONLY|syscall.O_DIRECTORY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open directory: %w", err)
+	}
+	defer syscall.Close(dirfd)
+	if err := syscall.Fsync(dirfd); err != nil {
+		return fmt.Errorf("fsync directory: %w", err)
+	}
+	return nil
+}
+
+func checkOptions(opts *Options) error {
+	if opts.PageSize != 0 && opts.PageSize != BTREE_PAGE_SIZE {
+		return fmt.Errorf("unsupported page size: %d", opts.PageSize)
+	}
+	if opts.Sync != SYNC_FULL && opts.Sync != SYNC_NONE {
+		return fmt.Errorf("bad sync mode: %d", opts.Sync)
+	}
+	if opts.MmapSize < 0 || opts.MmapSize%BTREE_PAGE_SIZE != 0 {
+		return fmt.Errorf("bad mmap size: %d", opts.MmapSize)
+	}
+	if opts.MmapSize == 0 {
+		opts.MmapSize = DEFAULT_MMAP_SIZE
+	}
+	if opts.FeedSize < 0 {
+		return fmt.Errorf("bad feed size: %d", opts.FeedSize)
+	}
+	if opts.FeedSize == 0 {
+		opts.FeedSize = DEFAULT_FEED_SIZE
+	}
+	return nil
+}
+
+func logf(db *KV, format string, args ...interface{}) {
+	if db.Options.Logger != nil {
+		db.Options.Logger.Printf(format, args...)
+	}
+}
 
 func(db *KV) Open() error{
+	if err := checkOptions(&db.Options); err != nil {
+		return err
+	}
+	// only 1 writer process at a time ,see fileLock.go
+	// the writer lock is taken first ,a racing writer cannot create the file too
+	db.fd = -1
+	if err := lockWriter(db); err != nil {
+		return err
+	}
+	fd, err := openFile(db)
+	if err != nil {
+		unlockDB(db)
+		return err
+	}
+	db.fd = fd
+	if err := lockReader(db); err != nil {
+		unlockDB(db)
+		syscall.Close(db.fd)
+		return err
+	}
+
+	// map the existing file and read the root from the meta page
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(db.fd, &stat); err != nil {
+		unlockDB(db)
+		syscall.Close(db.fd)
+		return fmt.Errorf("stat: %w", err)
+	}
+	if err := extendedMmap(db, int(stat.Size)); err != nil {
+		unlockDB(db)
+		syscall.Close(db.fd)
+		return err
+	}
+	if err := readRoot(db, stat.Size); err != nil {
+		unlockDB(db)
+		syscall.Close(db.fd)
+		return err
+	}
+	db.page.updates = map[uint64][]byte{}
+	db.page.written = map[uint64]uint64{}
+	db.page.trackedSince = db.version
+	feedInit(db)
+
 	db.tree.get = db.pageRead // read a page
 	// db.tree.new = db.pageAppend // append a page
 	// db.tree.del={}
-	db.tree.new = db.pageAlloc // (new) reuse from the free list or append
-db.tree.del = db.free.PushTail // (new) freed pages go to the free list
-// free list callbacks
-db.free.get = db.pageRead // read a page
-db.free.new = db.pageAppend // append a page
-db.free.set = db.pageWrite // (new) in-place updates
+	db.tree.new = db.pageAlloc     // (new) reuse from the free list or append
+	db.tree.del = db.free.PushTail // (new) freed pages go to the free list
+	// free list callbacks
+	db.free.get = db.pageRead   // read a page
+	db.free.new = db.pageAppend // append a page
+	db.free.set = db.pageWrite  // (new) in-place updates
+	logf(db, "opened %s (read-only: %v, pages: %d)", db.Path, db.Options.ReadOnly, db.page.flushed)
+	return nil
 }
+
+// Close flushes pending pages ,unmaps the file and releases the locks.
+// The KV cannot be used after this.
+func (db *KV) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+	closeFeed(db)
+
+	var err error
+	if !db.Options.ReadOnly && len(db.page.temp) > 0 {
+		err = updateFile(db)
+	}
+	for _, chunk := range db.mmap.chunks {
+		if e := syscall.Munmap(chunk); e != nil && err == nil {
+			err = fmt.Errorf("munmap: %w", e)
+		}
+	}
+	db.mmap.chunks = nil
+	db.mmap.total = 0
+	unlockDB(db)
+	if e := syscall.Close(db.fd); e != nil && err == nil {
+		err = fmt.Errorf("close: %w", e)
+	}
+	logf(db, "closed %s", db.Path)
+	return err
+}
+
+// saving pages into disk ,swapping them into ram when required
+//
+//	syscall.Mmap(fd, offset, size, syscall.PROT_READ, syscall.MAP_SHARED)
+//
 // fd = File descriptors allow programs to perform operations like reading, writing, or closing the file without needing to know the underlying details of the resource.
 // offset = from where to start reading
 // PROT_READ = means the mapped memory can be read but not necessarily written to.
 // MAP_SHARED = 	means changes to the mapped memory are shared with other processes that map the same file.
-syscall.Mmap(fd,offset,size,syscall.PROT_READ,syscall.MAP_SHARED)
 
+// callback for BTree and FreeList ,pages written by the current update are not in the mmap yet
+func (db *KV) pageRead(ptr uint64) []byte {
+	if node, ok := db.page.updates[ptr]; ok {
+		return node // pending update
+	}
+	if ptr >= db.page.flushed {
+		return db.page.temp[ptr-db.page.flushed] // appended by the current update
+	}
+	return mmapRead(ptr, db.mmap.chunks)
+}
 
-func (db *KV) pageRead(ptr uint64)[]byte{
+// read a page from a list of mmap chunks
+// snapshots keep their own copy of the list ,so new chunks added by writers dont affect them
+func mmapRead(ptr uint64, chunks [][]byte) []byte {
 	// mmap chunks have local index , so start is used to find the chunk from local start to end
 	start := uint64(0)
-	for _ , chunk = range db.mmap.chunks{
-		end = start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end{
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+		if ptr < end {
 			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return chunk[offset:offset*BTREE_PAGE_SIZE]
+			return chunk[offset : offset+BTREE_PAGE_SIZE]
 		}
-		start=end
+		start = end
 	}
 	panic("bad ptr")
 }
@@ -155,19 +384,19 @@ func extendedMmap(db *KV,size int)error{
 		return nil // we have enough space
 	}
 
-	// check if the total of mmap is greater or 64 
-	// if total is greater ,intialize alloc with it else with 64 MB
-	alloc := max(db.mmap.total,64<<20)
+	// check if the total of mmap is greater or the initial size (64MB by default)
+	// if total is greater ,intialize alloc with it else with the initial size
+	alloc := max(db.mmap.total,db.Options.MmapSize)
 
 	for db.mmap.total + alloc <size{
-		alloc * 2 // if total + alloc isnt equal to size we need,then double it
+		alloc *= 2 // if total + alloc isnt equal to size we need,then double it
 	}
 
 // 	int64(db.mmap.total): Offset (where new memory mapping starts).
 // alloc: Size of the new mapping.
 // syscall.PROT_READ: Read-only access.
 // syscall.MAP_SHARED: Changes are shared with other processes.
-	chunk err := syscall.Mmap(db.fd,int64(db.mmap.total),alloc,syscall.PROT_READ,syscall.MAP_SHARED)
+	chunk, err := syscall.Mmap(db.fd,int64(db.mmap.total),alloc,syscall.PROT_READ,syscall.MAP_SHARED)
 	if err !=nil{
 		return fmt.Errorf("mmap : %w",err)
 	}
@@ -195,6 +424,32 @@ func (db *KV) pageAppend(node []byte) uint64 {
     return ptr
 }
 
+// callback for BTree ,reuse a page from the free list or append one
+func (db *KV) pageAlloc(node []byte) uint64 {
+	if ptr := db.free.PopHead(); ptr != 0 {
+		db.page.updates[ptr] = node
+		return ptr
+	}
+	return db.pageAppend(node)
+}
+
+// callback for FreeList ,update an existing page in place
+func (db *KV) pageWrite(ptr uint64) []byte {
+	if node, ok := db.page.updates[ptr]; ok {
+		return node // pending update
+	}
+	if ptr >= db.page.flushed {
+		return db.page.temp[ptr-db.page.flushed] // appended by the current update
+	}
+	node := make([]byte, BTREE_PAGE_SIZE)
+	copy(node, db.pageRead(ptr)) // initialized from the file
+	db.page.updates[ptr] = node
+	return node
+}
+
+// IOV_MAX on linux ,pwritev fails with EINVAL if given more buffers
+const PWRITEV_MAX = 1024
+
 func writePages(db *KV) error{
 	// extend MMap if required
 	// `size` : size required to extend the MMap
@@ -213,46 +468,100 @@ func writePages(db *KV) error{
 	// `db.fd` : file descriptor 
 	// `db.page.temp` : pages store in temp memory
 	// `offset` : from where to start writing
-	if _,err := unix.Pwritev(db.fd,db.page.temp,offset);err!=nil{
-		return err
+	// at most `PWRITEV_MAX` pages per call
+	for temp := db.page.temp; len(temp) > 0; {
+		n := min(len(temp), PWRITEV_MAX)
+		if _, err := unix.Pwritev(db.fd, temp[:n], offset); err != nil {
+			return fmt.Errorf("write pages: %w", err)
+		}
+		temp, offset = temp[n:], offset+int64(n*BTREE_PAGE_SIZE)
 	}
 
 	// discard in-memory data
 
 	// increasing the size of flushed
+	for i := range db.page.temp {
+		markPageWritten(db, db.page.flushed+uint64(i))
+	}
 	db.page.flushed += uint64(len(db.page.temp))
 	// emptying temp array of bytes 
 	// resetting the byte array without deleting it
 	// slice length = 0
 	db.page.temp = db.page.temp[:0]
+
+	// in-place updates ,pages reused from the free list
+	for ptr, node := range db.page.updates {
+		if _, err := syscall.Pwrite(db.fd, node, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
+		markPageWritten(db, ptr)
+	}
+	clear(db.page.updates)
 	return nil
 }
 
 func saveMeta(db *KV) []byte{
-	// meta data is of 32 bytes
-	var data[32] byte
-	copy(data[:16],[]byte(DB_SIG))
-	binary.LittleEndian.AppendUint64(data[16:],db.tree.root)
-	binary.LittleEndian.AppendUint64(data[24:],db.page.flushed)
+	return encodeMeta(db.tree.root, db.page.flushed, db.version)
+}
+
+// meta data is of `META_SIZE` bytes
+func encodeMeta(root uint64, flushed uint64, version uint64) []byte {
+	var data [META_SIZE]byte
+	copy(data[:16], []byte(DB_SIG))
+	binary.LittleEndian.PutUint64(data[16:], root)
+	binary.LittleEndian.PutUint64(data[24:], flushed)
+	binary.LittleEndian.PutUint64(data[32:], version)
 	return data[:]
 }
 
-func loadMeta(db *KV, data []byte)
+// returns root ,flushed ,version
+func decodeMeta(data []byte) (uint64, uint64, uint64, error) {
+	if len(data) < META_SIZE {
+		return 0, 0, 0, errors.New("bad signature")
+	}
+	if sig := string(data[:16]); sig != DB_SIG {
+		if strings.HasPrefix(sig, DB_SIG_PREFIX) {
+			return 0, 0, 0, fmt.Errorf("unsupported file format %q ,written by an older version (expected %q)", sig, DB_SIG)
+		}
+		return 0, 0, 0, errors.New("bad signature")
+	}
+	root := binary.LittleEndian.Uint64(data[16:])
+	flushed := binary.LittleEndian.Uint64(data[24:])
+	version := binary.LittleEndian.Uint64(data[32:])
+	return root, flushed, version, nil
+}
+
+func loadMeta(db *KV, data []byte) {
+	root, flushed, version, err := decodeMeta(data)
+	assert(err == nil) // only called on a verified page
+	db.tree.root = root
+	db.page.flushed = flushed
+	db.version = version
+}
 
 func readRoot(db *KV, fileSize int64) error {
+	if fileSize == 0 && db.Options.ReadOnly {
+		// nobody can initialize the meta page for us
+		return errors.New("read-only open of an empty file")
+	}
 	if fileSize == 0 { // empty file
 	db.page.flushed = 1 // the meta page is initialized on the 1st write
 	return nil
 	}
 	// read the page
 	data := db.mmap.chunks[0]
-	loadMeta(db, data)
 	// verify the page
-	// ...
+	if _, _, _, err := decodeMeta(data); err != nil {
+		return err
+	}
+	loadMeta(db, data)
 	return nil
 }
 	
 func updateRoot(db *KV) error{
+	if db.Options.ReadOnly {
+		return ErrReadOnly // the meta page of a read-only file is never rewritten
+	}
 	if _,err := syscall.Pwrite(db.fd,saveMeta(db),0);err!=nil{
 		return fmt.Errorf("write meta page :%w",err)
 	}
@@ -260,6 +569,9 @@ func updateRoot(db *KV) error{
 }
 
 func (db *KV) Set(key []byte,val []byte) error{
+	if err := checkWritable(db); err != nil {
+		return err
+	}
 	meta := saveMeta(db)
 	db.tree.Insert(key,val)
 	return updateOrRevert(db,meta)
@@ -274,6 +586,7 @@ func updateOrRevert(db *KV,meta []byte)error{
 		loadMeta(db,meta)
 		// discard temporaries
 		db.page.temp=db.page.temp[:0]
+		clear(db.page.updates)
 
 	}
 
@@ -1,10 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
 )
 
+// usage: db <file> ,runs the statements from stdin ,1 per line
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: db <file>")
+		os.Exit(2)
+	}
+	db := &DB{Path: os.Args[1]}
+	db.kv.Path = db.Path
+	if err := db.kv.Open(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.kv.Close()
+
+	input := bufio.NewScanner(os.Stdin)
+	for input.Scan() {
+		line := strings.TrimSpace(input.Text())
+		if line == "" {
+			continue
+		}
+		count, err := db.Exec(line)
+		if err != nil {
+			fmt.Println("error:", err)
+		} else {
+			fmt.Println(count, "rows")
+		}
+	}
+}
+
 // 1KB = 4096 bytes
 // HEADER is used to store meta data about a node
 const HEADER = 4 // 4 BYTES
@@ -34,10 +67,18 @@ type BTree struct {
 }
 
 func init() {
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VALUE_SIZE
+	// +1 for the flag of a pending update ,see `KVTX`
+	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VALUE_SIZE + 1
 	assert(node1max <= BTREE_PAGE_SIZE)
 }
 
+// a broken invariant is a bug ,not an error to return
+func assert(cond bool) {
+	if !cond {
+		panic("assertion failure")
+	}
+}
+
 // type of node
 // nkeys = no of keys in a node
 // pointers = array of pointers where each pointers if of 8 bytes || pointers points to child and its an integer and Pointers store the disk offset (byte position) of a child node.
@@ -64,8 +105,8 @@ const (
 // LittleEndian for getPtr → Optimized for memory access in modern CPUs.
 
 // return type of node
-func (node BNode) btype() uint64 {
-	return binary.BigEndian.Uint64(node[0:2])
+func (node BNode) btype() uint16 {
+	return binary.BigEndian.Uint16(node[0:2])
 }
 
 // return number of keys
@@ -75,8 +116,8 @@ func (node BNode) nkeys() uint16 {
 
 // set header
 func (node BNode) setHeader(btype uint16, nkeys uint16) {
-	binary.LittleEndian.PutUint16(node[0:2], btype)
-	binary.LittleEndian.PutUint16(node[2:4], nkeys)
+	binary.BigEndian.PutUint16(node[0:2], btype)
+	binary.BigEndian.PutUint16(node[2:4], nkeys)
 }
 
 // retrieve the CHILD using POINTER
@@ -86,6 +127,12 @@ func (node BNode) getPtr(index uint16) uint64 {
 	return binary.LittleEndian.Uint64(node[pos:])
 }
 
+func (node BNode) setPtr(index uint16, ptr uint64) {
+	assert(index < node.nkeys())
+	pos := HEADER + 8*index
+	binary.LittleEndian.PutUint64(node[pos:], ptr)
+}
+
 // offset tells the position of key and value pair
 
 // Offset list
@@ -101,11 +148,13 @@ func (node BNode) getOffset(index uint16) uint16 {
 	if index == 0 {
 		return 0
 	}
-	return binary.LittleEndian.Uint16(node[offsetPos(node, index):])
+	return binary.LittleEndian.Uint16(node[node.offsetPos(index):])
 }
 
 // set offset
-func (node BNode) setOffset(index uint16, offset uint16)
+func (node BNode) setOffset(index uint16, offset uint16) {
+	binary.LittleEndian.PutUint16(node[node.offsetPos(index):], offset)
+}
 
 // get the starting postion
 func (node BNode) kvPos(index uint16) uint16 {
@@ -115,13 +164,19 @@ func (node BNode) kvPos(index uint16) uint16 {
 
 // get the key ,skip 4 bytes and then procceed
 func (node BNode) getKey(index uint16) []byte {
-	assert(index <= node.nkeys())
+	assert(index < node.nkeys())
 	pos := node.kvPos(index)
 	klen := binary.LittleEndian.Uint16(node[pos:])
 	return node[pos+4:][:klen]
 }
 
-func (node BNode) getVal(index int16) []byte
+func (node BNode) getVal(index uint16) []byte {
+	assert(index < node.nkeys())
+	pos := node.kvPos(index)
+	klen := binary.LittleEndian.Uint16(node[pos+0:])
+	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	return node[pos+4+klen:][:vlen]
+}
 
 func (node BNode) nbytes() uint16 {
 	return node.kvPos(uint16(node.nkeys()))
@@ -166,7 +221,7 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 // Add a new key to leaf node
 
 func leafInsert(new BNode, old BNode, index uint16, key []byte, val []byte) {
-	new.setHeader(BNODE_LEAF, old.nbytes()+1) // setting up header
+	new.setHeader(BNODE_LEAF, old.nkeys()+1) // setting up header
 	nodeAppendRange(new, old, 0, 0, index)    // copy the keys and values before the index
 
 	// insert the key in the new node
@@ -176,6 +231,14 @@ func leafInsert(new BNode, old BNode, index uint16, key []byte, val []byte) {
 	nodeAppendRange(new, old, index+1, index, old.nkeys()-index)
 }
 
+// update an existing key in a leaf node
+func leafUpdate(new BNode, old BNode, index uint16, key []byte, val []byte) {
+	new.setHeader(BNODE_LEAF, old.nkeys())
+	nodeAppendRange(new, old, 0, 0, index)
+	nodeAppendKv(new, index, 0, key, val)
+	nodeAppendRange(new, old, index+1, index+1, old.nkeys()-(index+1))
+}
+
 // Copy a KV into the position
 
 func nodeAppendKv(new BNode, index uint16, ptr uint64, key []byte, val []byte) {
@@ -188,10 +251,10 @@ func nodeAppendKv(new BNode, index uint16, ptr uint64, key []byte, val []byte) {
 	pos := new.kvPos(index) // calculate the position for KV storage
 
 	// store the length of the key in first 2 byte
-	binary.LittleEndian.AppendUint16(new[pos+0:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(new[pos+0:], uint16(len(key)))
 
 	// store the length of the value in next 2 bytes
-	binary.LittleEndian.AppendUint16(new[pos+2:], uint16(len(val)))
+	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val)))
 
 	// copy the old key and value in new node
 	copy(new[pos+4:], key)
@@ -202,11 +265,18 @@ func nodeAppendKv(new BNode, index uint16, ptr uint64, key []byte, val []byte) {
 
 }
 
-func nodeAppendRange(new BNode, old BNode, newDst uint16, oldSrc uint16, n uint16) {}
+// copy `n` KVs from `old` to `new` ,in order
+func nodeAppendRange(new BNode, old BNode, newDst uint16, oldSrc uint16, n uint16) {
+	for i := uint16(0); i < n; i++ {
+		dst, src := newDst+i, oldSrc+i
+		nodeAppendKv(new, dst, old.getPtr(src), old.getKey(src), old.getVal(src))
+	}
+}
 
 func nodeReplaceKidN(tree *BTree, new BNode, old BNode, index uint16, kids ...BNode) {
 	noOfKids := uint16(len(kids))
 	new.setHeader(BNODE_NODE, old.nkeys()+noOfKids-1)
+	nodeAppendRange(new, old, 0, 0, index)
 	for i, node := range kids {
 		nodeAppendKv(new, index+uint16(i), tree.new(node), node.getKey(0), nil)
 	}
@@ -214,7 +284,35 @@ func nodeReplaceKidN(tree *BTree, new BNode, old BNode, index uint16, kids ...BN
 }
 
 // Split a oversized node into 2 so that the 2nd node always fits on a page
-func nodeSplit2(left BNode, right BNode, old BNode) {}
+func nodeSplit2(left BNode, right BNode, old BNode) {
+	assert(old.nkeys() >= 2)
+	// the initial guess
+	nleft := old.nkeys() / 2
+	// try to fit the left half
+	leftBytes := func() uint16 {
+		return HEADER + 10*nleft + old.getOffset(nleft)
+	}
+	for leftBytes() > BTREE_PAGE_SIZE {
+		nleft--
+	}
+	assert(nleft >= 1)
+	// try to fit the right half
+	rightBytes := func() uint16 {
+		return old.nbytes() - leftBytes() + HEADER
+	}
+	for rightBytes() > BTREE_PAGE_SIZE {
+		nleft++
+	}
+	assert(nleft < old.nkeys())
+	nright := old.nkeys() - nleft
+
+	left.setHeader(old.btype(), nleft)
+	right.setHeader(old.btype(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+	// the left half may be still too big
+	assert(right.nbytes() <= BTREE_PAGE_SIZE)
+}
 
 // Split a node into 2 ,if its big split it into 3
 func nodeSplit3(old BNode) (uint16, [3]BNode) {
@@ -240,7 +338,7 @@ func nodeSplit3(old BNode) (uint16, [3]BNode) {
 	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
 	nodeSplit2(leftleft, middle, left)
 	assert(leftleft.nbytes() <= BTREE_PAGE_SIZE)
-	return 3, [3]BNode{left, middle, right} // returning three nodes
+	return 3, [3]BNode{leftleft, middle, right} // returning three nodes
 }
 
 // insert a KV into a node, the result might be split.
@@ -251,7 +349,7 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 
 	// the result node
 	// it is allowed to be bigger than 1 page size and will be split if so
-	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
 
 	// where to insert the key ???
 	// find the key which should be <= new key
@@ -283,7 +381,7 @@ func nodeInsert(tree *BTree, new BNode, node BNode, index uint16, key []byte, va
 	kptr := node.getPtr(index)
 
 	// recursive insertion to the kid node
-	knode := treeInsert(tree, node, key, val)
+	knode := treeInsert(tree, tree.get(kptr), key, val)
 
 	// split the result
 	nsplit, split := nodeSplit3(knode)
@@ -325,7 +423,7 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	if nsplit > 1 {
 		// the root was split and add a new level
 		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_LEAF, nsplit)
+		root.setHeader(BNODE_NODE, nsplit)
 		for i, knode := range split[:nsplit] {
 			ptr, key := tree.new(knode), knode.getKey(0)
 			nodeAppendKv(root, uint16(i), ptr, key, nil)
@@ -339,13 +437,27 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 // Node update functions for tree deleting
 
 // remove a key from a leaf node
-func leadDelete(new BNode, old BNode, index uint16)
+func leafDelete(new BNode, old BNode, index uint16) {
+	new.setHeader(BNODE_LEAF, old.nkeys()-1)
+	nodeAppendRange(new, old, 0, 0, index)
+	nodeAppendRange(new, old, index, index+1, old.nkeys()-(index+1))
+}
 
 // merge 2 nodes into 1
-func nodeMerge(new BNode, left BNode, right BNode)
+func nodeMerge(new BNode, left BNode, right BNode) {
+	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	nodeAppendRange(new, left, 0, 0, left.nkeys())
+	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
+	assert(new.nbytes() <= BTREE_PAGE_SIZE)
+}
 
 // replace 2 adjacent links with 1
-func nodeReplace2Kid(new BNode, old BNode, index uint16, ptr uint64, key []byte)
+func nodeReplace2Kid(new BNode, old BNode, index uint16, ptr uint64, key []byte) {
+	new.setHeader(BNODE_NODE, old.nkeys()-1)
+	nodeAppendRange(new, old, 0, 0, index)
+	nodeAppendKv(new, index, ptr, key, nil)
+	nodeAppendRange(new, old, index+1, index+2, old.nkeys()-(index+2))
+}
 
 func shouldMerge(tree *BTree, node BNode, index uint16, updated BNode) (int, BNode) {
 
@@ -381,7 +493,23 @@ func shouldMerge(tree *BTree, node BNode, index uint16, updated BNode) (int, BNo
 }
 
 // delete a key from the tree
-func treeDelete(tree *BTree, node BNode, key []byte) BNode
+// returns an empty node if the key is not found
+func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+	index := nodeLookupLE(node, key)
+	switch node.btype() {
+	case BNODE_LEAF:
+		if !bytes.Equal(key, node.getKey(index)) {
+			return BNode{} // not found
+		}
+		new := BNode(make([]byte, BTREE_PAGE_SIZE))
+		leafDelete(new, node, index)
+		return new
+	case BNODE_NODE:
+		return nodeDelete(tree, node, index, key)
+	default:
+		panic("bad node!!")
+	}
+}
 
 // delete a key from internal node ; part of the treeDelete()
 func nodeDelete(tree *BTree, node BNode, index uint16, key []byte) BNode {
@@ -418,3 +546,75 @@ func nodeDelete(tree *BTree, node BNode, index uint16, key []byte) BNode {
 	return new
 }
 
+
+// returns false if the key is not found
+func (tree *BTree) Delete(key []byte) bool {
+	if tree.root == 0 || len(key) == 0 {
+		return false // the empty key is the sentinel
+	}
+	updated := treeDelete(tree, tree.get(tree.root), key)
+	if len(updated) == 0 {
+		return false // not found
+	}
+	tree.del(tree.root)
+	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+		// remove a level
+		tree.root = updated.getPtr(0)
+	} else {
+		tree.root = tree.new(updated)
+	}
+	return true
+}
+
+// point query
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+	if tree.root == 0 {
+		return nil, false
+	}
+	node := BNode(tree.get(tree.root))
+	for {
+		index := nodeLookupLE(node, key)
+		switch node.btype() {
+		case BNODE_LEAF:
+			if !bytes.Equal(key, node.getKey(index)) {
+				return nil, false
+			}
+			return node.getVal(index), true
+		case BNODE_NODE:
+			node = tree.get(node.getPtr(index))
+		default:
+			panic("bad node!!")
+		}
+	}
+}
+
+// insert or update a key ,depending on `req.Mode`
+// returns false if nothing was changed
+func (tree *BTree) Update(req *UpdateReq) bool {
+	assert(len(req.Key) > 0 && len(req.Key) <= BTREE_MAX_KEY_SIZE)
+	assert(len(req.Val) <= BTREE_MAX_VALUE_SIZE)
+	old, exists := tree.Get(req.Key)
+	if !updateAllowed(req, old, exists) {
+		return false
+	}
+	if exists {
+		req.Old = append([]byte(nil), old...) // the page can be reused
+	}
+	tree.Insert(req.Key, req.Val)
+	req.Added = !exists
+	req.Updated = true
+	return true
+}
+
+// does `req.Mode` allow the update ,and does it change anything ?
+func updateAllowed(req *UpdateReq, old []byte, exists bool) bool {
+	switch {
+	case req.Mode == MODE_UPDATE_ONLY && !exists:
+		return false
+	case req.Mode == MODE_INSERT_ONLY && exists:
+		return false
+	case exists && bytes.Equal(old, req.Val):
+		return false // same value
+	}
+	return true
+}
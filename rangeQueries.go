@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"math"
 	"slices"
 )
 
@@ -18,6 +21,12 @@ type Scanner struct {
 	Cmp2 int
 	Key1 Record
 	Key2 Record
+	// internal
+	tx     *DBTX
+	tdef   *TableDef
+	index  int    // which index ,0 is the primary key
+	iter   *CombinedIter // the underlying B-tree iterator
+	keyEnd []byte // the encoded Key2
 }
 type BIter struct {
 	tree *BTree
@@ -35,47 +44,110 @@ type RecordIter interface {
 func (tree *BTree) SeekLE(key []byte) *BIter {
 	iter := &BIter{tree: tree}
 	for ptr := tree.root; ptr != 0; {
-		node := tree.get(ptr)
+		node := BNode(tree.get(ptr))
 		index := nodeLookupLE(node, key)
 		iter.path = append(iter.path, node)
 		iter.pos = append(iter.pos, index)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
 		ptr = node.getPtr(index)
 	}
+	return iter
+}
+
+// find the closest pos to `key` that satisfies `cmp` ,see `CMP_*`
+func (tree *BTree) Seek(key []byte, cmp int) *BIter {
+	iter := tree.SeekLE(key)
+	if cmp != CMP_LE && len(iter.path) > 0 {
+		// the sentinel is checked too ,it is before every key
+		last := len(iter.path) - 1
+		cur := iter.path[last].getKey(iter.pos[last])
+		if !cmpOK(cur, cmp, key) || (cmp > 0 && !iter.Valid()) {
+			// off by one
+			if cmp > 0 {
+				iter.Next()
+			} else {
+				iter.Prev()
+			}
+		}
+	}
+	return iter
 }
 
 // get the current KV pair
 
-func (iter *BIter) Deref() ([]byte, []byte)
+func (iter *BIter) Deref() ([]byte, []byte) {
+	assert(iter.Valid())
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	return node.getKey(iter.pos[last]), node.getVal(iter.pos[last])
+}
 
 // pre  condition of Deref()
+// the empty key at the start of the tree is the sentinel ,not a real key
 
-func (iter *BIter) Valid() bool
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false // empty tree
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return false // moved past either end
+	}
+	return slices.ContainsFunc(iter.pos, func(pos uint16) bool { return pos != 0 })
+}
 
+// the update goes into the pending tree ,`KV.Commit()` applies it to the db
 func (tx *KVTX) Update(req *UpdateReq) bool {
-	return tx.db.tree.Update(req)
+	old, exists := tx.Get(req.Key)
+	if !updateAllowed(req, old, exists) {
+		return false
+	}
+	if exists {
+		req.Old = append([]byte(nil), old...)
+	}
+	tx.pending.Insert(req.Key, append([]byte{FLAG_UPDATED}, req.Val...))
+	req.Added = !exists
+	req.Updated = true
+	return true
 }
+
+// the key is marked as deleted in the pending tree
 func (tx *KVTX) Del(req *DeleteReq) bool {
-	return tx.db.tree.Delete(req)
+	old, exists := tx.Get(req.Key)
+	if !exists {
+		return false
+	}
+	req.Old = append([]byte(nil), old...)
+	tx.pending.Insert(req.Key, []byte{FLAG_DELETED})
+	return true
 }
 
 // moving backward and forward
 
-func (iter *BIter) Prev()
+// after the last key ,or before the 1st one ,the iterator is invalid
+func (iter *BIter) Prev() {
+	if len(iter.path) > 0 && !iterPrev(iter, len(iter.path)-1) {
+		iter.pos[len(iter.pos)-1] = math.MaxUint16 // before the 1st key
+	}
+}
 func (iter *BIter) Next() {
-	iterNext(iter, len(iter.path)-1)
+	if len(iter.path) > 0 && !iterNext(iter, len(iter.path)-1) {
+		last := len(iter.pos) - 1
+		iter.pos[last] = iter.path[last].nkeys() // after the last key
+	}
 }
 
-func iterNext(iter *BIter, level int) {
+// returns false at the end ,the path is not changed then
+func iterNext(iter *BIter, level int) bool {
 	if iter.pos[level]+1 < iter.path[level].nkeys() {
 		iter.pos[level]++ // iterate within node
-	} else if level > 0 { // if level is greater than 0 ,i.e root => 0, not root
-		// as of now we havent linked leaf nodes as doubly linked list so we need to backtrack to parent and then to sibings
-		iterNext(iter, level-1) // lets backtrack to parent node
-	} else {
+	} else if level == 0 || !iterNext(iter, level-1) {
 		// there is no next key to iterate ,return back
-		iter.pos[len(iter.pos)-1]++
-		return
+		return false
 	}
+	// as of now we havent linked leaf nodes as doubly linked list so we need to backtrack to parent and then to sibings
 
 	if level+1 < len(iter.pos) {
 		node := iter.path[level]
@@ -83,32 +155,198 @@ func iterNext(iter *BIter, level int) {
 		iter.path[level+1] = kid
 		iter.pos[level+1] = 0
 	}
+	return true
+}
+
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]--
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false
+	}
+	if level+1 < len(iter.pos) {
+		node := iter.path[level]
+		kid := BNode(iter.tree.get(node.getPtr(iter.pos[level])))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true
 }
 
-func (tx *KVTX) Seek(key []byte, cmp int) *BIter {
-	return tx.db.tree.Seek(key, cmp)
+// the pending updates over the snapshot ,see `CombinedIter`
+// the range from `key` to where the iterator stops is recorded as read
+func (tx *KVTX) Seek(key []byte, cmp int) *CombinedIter {
+	iter := &CombinedIter{
+		top:  tx.pending.Seek(key, cmp),
+		bot:  tx.snapshot.Seek(key, cmp),
+		dir:  cmp,
+		tx:   tx,
+		read: len(tx.read),
+	}
+	start := append([]byte(nil), key...)
+	tx.read = append(tx.read, KeyRange{start, start})
+	iter.skipDeleted()
+	iter.track()
+	return iter
 }
 
 // within the range or not?
-func (sc *Scanner) Valid() bool
+func (sc *Scanner) Valid() bool {
+	if !sc.iter.Valid() {
+		return false
+	}
+	key, _ := sc.iter.Deref()
+	return cmpOK(key, sc.Cmp2, sc.keyEnd)
+}
 
 // move the underlying B-tree iterator
-func (sc *Scanner) Next()
+func (sc *Scanner) Next() {
+	assert(sc.Valid())
+	if sc.Cmp1 > 0 {
+		sc.iter.Next()
+	} else {
+		sc.iter.Prev()
+	}
+}
 
 // fetch the current row
-func (sc *Scanner) Deref(rec *Record)
-func (tx *DBTX) Scan(table string, req *Scanner) error
+// from a secondary index ,the primary key is decoded from the index key
+// (or the value for a unique index) and the row is read from the table
+// the current row ,without `@rowid`
+func (sc *Scanner) Deref(rec *Record) error {
+	if err := sc.deref(rec); err != nil {
+		return err
+	}
+	userRecord(rec)
+	return nil
+}
+
+// the full row ,for internal updates that need the primary key
+func (sc *Scanner) deref(rec *Record) error {
+	assert(sc.Valid())
+	tdef := sc.tdef
+	key, val := sc.iter.Deref()
+	pkey := make([]Value, tdef.Pkeys)
+	for i := range pkey {
+		pkey[i].Type = tdef.Types[i]
+	}
+
+	if sc.index == 0 {
+		decodeKey(key, pkey)
+		rec.Cols = tdef.Cols
+		rec.Vals = decodeRow(tdef, pkey, val)
+		return nil
+	}
+
+	if isUnique(tdef, sc.index) {
+		decodeValues(val, pkey)
+	} else {
+		// the primary key columns are part of the index key
+		index := tdef.Indexes[sc.index]
+		ivals := make([]Value, len(index))
+		for i, col := range index {
+			ivals[i].Type = indexColumnType(tdef, col)
+		}
+		decodeKey(key, ivals)
+		for i := range pkey {
+			pkey[i] = ivals[slices.Index(index, tdef.Cols[i])]
+		}
+	}
+	*rec = Record{Cols: slices.Clone(tdef.Cols[:tdef.Pkeys]), Vals: pkey}
+	ok, err := dbGet(sc.tx, tdef, rec)
+	if err != nil {
+		return err
+	}
+	assert(ok) // the index must be consistent with the rows
+	return nil
+}
+
+// the type of the values of an index column
+func indexColumnType(tdef *TableDef, col string) uint32 {
+	expr, err := parseIndexExpr(col)
+	assert(err == nil)
+	switch {
+	case len(expr.Path) == 0:
+		return tdef.Types[slices.Index(tdef.Cols, col)]
+	case expr.Text:
+		return TYPE_BYTES
+	default:
+		return TYPE_JSON
+	}
+}
+
+func (tx *DBTX) Scan(table string, req *Scanner) error {
+	tdef, err := findTableDef(tx, table)
+	if err != nil {
+		return err
+	}
+	return dbScan(tx, tdef, req)
+}
+
+// compare a key with the end of the range
+func cmpOK(key []byte, cmp int, ref []byte) bool {
+	r := bytes.Compare(key, ref)
+	switch cmp {
+	case CMP_GE:
+		return r >= 0
+	case CMP_GT:
+		return r > 0
+	case CMP_LT:
+		return r < 0
+	case CMP_LE:
+		return r <= 0
+	default:
+		panic("what ???")
+	}
+}
+
+func dbScan(tx *DBTX, tdef *TableDef, req *Scanner) error {
+	// the range must go from 1 end to the other
+	switch {
+	case req.Cmp1 > 0 && req.Cmp2 < 0:
+	case req.Cmp2 > 0 && req.Cmp1 < 0:
+	default:
+		return fmt.Errorf("bad range")
+	}
 
-func dbScan(db *DB, tdef *TableDef, req *Scanner) error {
-	// ...
 	covered := func(key []string, index []string) bool {
 		return len(index) >= len(key) && slices.Equal(index[:len(key)], key)
 	}
-	req.index = slices.IndexFunc(tdef.Indexes, func(index []string) bool {
-		return covered(req.Key1.Cols, index) && covered(req.Key2.Cols, index)
-	})
+	req.index = -1
+	for i, index := range tdef.Indexes {
+		if i > 0 && i == tdef.Building {
+			continue // not backfilled yet ,see `DB.IndexNew()`
+		}
+		if covered(req.Key1.Cols, index) && covered(req.Key2.Cols, index) {
+			req.index = i
+			break
+		}
+	}
+	if req.index < 0 {
+		return fmt.Errorf("table %s: no index for the range", tdef.Name)
+	}
+
+	// the values must have the types of the index columns ,eg `price > 10` on a FLOAT64 column
+	index := tdef.Indexes[req.index]
+	for _, key := range []*Record{&req.Key1, &req.Key2} {
+		vals := make([]Value, len(key.Vals)) // dont modify the caller's slice
+		for i, v := range key.Vals {
+			typ := indexColumnType(tdef, index[i])
+			var ok bool
+			if vals[i], ok = convertValue(v, typ); !ok {
+				return fmt.Errorf("table %s: range: column %s: type mismatch", tdef.Name, index[i])
+			}
+		}
+		key.Vals = vals
+	}
 
-	// ...
+	// the columns of the range are a prefix of the index ,in its order
+	req.tx, req.tdef = tx, tdef
+	prefix := tdef.Prefixes[req.index]
+	keyStart := encodeKeyPartial(nil, prefix, req.Key1.Vals, req.Cmp1)
+	req.keyEnd = encodeKeyPartial(nil, prefix, req.Key2.Vals, req.Cmp2)
+	req.iter = tx.kv.Seek(keyStart, req.Cmp1)
+	return nil
 }
 
 // order preserving encoding
@@ -117,12 +355,32 @@ func encodeValues(out []byte, vals []Value) []byte {
 	for _, v := range vals {
 		out = append(out, byte(v.Type)) // doesnt tsrat with 0xff
 		switch v.Type {
-		case TYPE_INT64:
+		case TYPE_NULL:
+			// just the tag ,0 sorts before the other types
+		case TYPE_INT64, TYPE_TIMESTAMP, TYPE_DECIMAL:
 			var buf [8]byte
 			u := uint64(v.I64) + (1 << 63)        //flip the sign bit,So that negative numbers sort before positive ones when comparing byte-wise
 			binary.BigEndian.PutUint64(buf[:], u) //big indian
 			out = append(out, buf[:]...)
-		case TYPE_BYTES:
+		case TYPE_FLOAT64:
+			// IEEE bits sort like sign-magnitude integers
+			// positive : flip the sign bit so they sort after the negatives
+			// negative : flip all the bits ,a bigger magnitude is a smaller number
+			var buf [8]byte
+			u := math.Float64bits(v.F64)
+			if v.F64 == 0 {
+				u = 0 // -0 == +0
+			}
+			if u&(1<<63) != 0 {
+				u = ^u
+			} else {
+				u ^= 1 << 63
+			}
+			binary.BigEndian.PutUint64(buf[:], u)
+			out = append(out, buf[:]...)
+		case TYPE_BOOL:
+			out = append(out, byte(v.I64))
+		case TYPE_BYTES, TYPE_JSON:
 			out = append(out, escapeString(v.Str)...)
 			out = append(out, 0) // null terminated
 		default:
@@ -132,6 +390,48 @@ func encodeValues(out []byte, vals []Value) []byte {
 	return out
 }
 
+// Strings are null terminated ,so a 0x00 inside a string must be escaped.
+// 0x01 is the escape byte :
+//
+//	0x00 -> 0x01 0x01
+//	0x01 -> 0x01 0x02
+//
+// The escaped bytes still sort in the same order ,and are all after the terminator,
+// so a string sorts before any longer string it is a prefix of.
+func escapeString(in []byte) []byte {
+	zeros := bytes.Count(in, []byte{0})
+	ones := bytes.Count(in, []byte{1})
+	if zeros+ones == 0 {
+		return in // nothing to escape
+	}
+	out := make([]byte, 0, len(in)+zeros+ones)
+	for _, ch := range in {
+		if ch <= 1 {
+			out = append(out, 0x01, ch+1)
+		} else {
+			out = append(out, ch)
+		}
+	}
+	return out
+}
+
+func unescapeString(in []byte) []byte {
+	if bytes.IndexByte(in, 1) < 0 {
+		return append([]byte(nil), in...) // a copy ,`in` may be in a page
+	}
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] == 0x01 {
+			i++
+			assert(i < len(in) && (in[i] == 1 || in[i] == 2))
+			out = append(out, in[i]-1)
+		} else {
+			out = append(out, in[i])
+		}
+	}
+	return out
+}
+
 // for primary keys and indexes
 func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
 
@@ -147,37 +447,65 @@ func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
 	return out
 }
 
+// decode the columns of a key ,`out` has the types set
+func decodeKey(in []byte, out []Value) {
+	decodeValues(in[4:], out) // skip the table prefix
+}
+
 // for the input range ,which can be a prefix of the key
 
 func encodeKeyPartial(out []byte, prefix uint32, vals []Value, cmp int) []byte {
 	out = encodeKey(out, prefix, vals)
 	// encode missing columns as infinity
-	if cmp == CMP_GT || cmp == CMP_LT {
+	// `> prefix` and `<= prefix` must include every key that starts with the prefix
+	if cmp == CMP_GT || cmp == CMP_LE {
 		// unreachable +infinity
 		out = append(out, 0xff)
 	} // else: -infinity is the empty string
 	return out
 }
+
+// the output expressions of a SELECT on the input rows
 type qlSelectIter struct {
-	iter RecordIter // input
+	iter  RecordIter // input
 	names []string
 	exprs []QLNode
-	}
-	func (iter *qlSelectIter) Valid() bool {
+}
+
+func (iter *qlSelectIter) Valid() bool {
 	return iter.iter.Valid()
-	}
-	func (iter *qlSelectIter) Next() {
+}
+func (iter *qlSelectIter) Next() {
 	iter.iter.Next()
-	}
-	func (iter *qlSelectIter) Deref(rec *Record) error {
+}
+func (iter *qlSelectIter) Deref(rec *Record) error {
 	if err := iter.iter.Deref(rec); err != nil {
-	return err
+		return err
 	}
-	vals, err := qlEvelMulti(*rec, iter.exprs)
+	out, err := qlEvalMulti(*rec, iter.names, iter.exprs)
 	if err != nil {
 		return err
+	}
+	*rec = out
+	return nil
+}
+
+// evaluate the output expressions on a row ,`*` is all the columns
+func qlEvalMulti(env Record, names []string, exprs []QLNode) (Record, error) {
+	out := Record{}
+	for i, node := range exprs {
+		if node.Type == QL_STAR {
+			out.Cols = append(out.Cols, env.Cols...)
+			out.Vals = append(out.Vals, env.Vals...)
+			continue
 		}
-		*rec = Record{iter.names, vals}
-		return nil
+		ctx := QLEvalContex{env: env}
+		qlEval(&ctx, node)
+		if ctx.err != nil {
+			return Record{}, ctx.err
 		}
-		
\ No newline at end of file
+		out.Cols = append(out.Cols, names[i])
+		out.Vals = append(out.Vals, ctx.out)
+	}
+	return out, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestEscapeString(t *testing.T) {
+	cases := []struct {
+		in  []byte
+		out []byte
+	}{
+		{[]byte(""), []byte("")},
+		{[]byte("abc"), []byte("abc")},
+		{[]byte{0}, []byte{1, 1}},
+		{[]byte{1}, []byte{1, 2}},
+		{[]byte{0, 1, 2}, []byte{1, 1, 1, 2, 2}},
+		{[]byte{'a', 0, 'b', 1}, []byte{'a', 1, 1, 'b', 1, 2}},
+		{[]byte{0xff, 0}, []byte{0xff, 1, 1}},
+	}
+	for _, c := range cases {
+		esc := escapeString(c.in)
+		if !bytes.Equal(esc, c.out) {
+			t.Errorf("escapeString(%q) = %q ,expected %q", c.in, esc, c.out)
+		}
+		if bytes.IndexByte(esc, 0) >= 0 {
+			t.Errorf("escapeString(%q) = %q has a 0x00", c.in, esc)
+		}
+		if back := unescapeString(esc); !bytes.Equal(back, c.in) {
+			t.Errorf("unescapeString(%q) = %q ,expected %q", esc, back, c.in)
+		}
+	}
+}
+
+// encoded strings sort like the strings ,a prefix sorts first
+func TestEncodeStringOrder(t *testing.T) {
+	sorted := [][]byte{
+		{},
+		{0},
+		{0, 0},
+		{0, 1},
+		{1},
+		{1, 0},
+		{2},
+		[]byte("a"),
+		{'a', 0},
+		{'a', 1},
+		[]byte("ab"),
+		[]byte("b"),
+		{0xff},
+		{0xff, 0xff},
+	}
+	checkSorted(t, stringValues(sorted))
+}
+
+func stringValues(strs [][]byte) []Value {
+	vals := []Value(nil)
+	for _, s := range strs {
+		vals = append(vals, Value{Type: TYPE_BYTES, Str: s})
+	}
+	return vals
+}
+
+func TestEncodeValuesOrder(t *testing.T) {
+	cases := []struct {
+		name string
+		vals []Value // ascending
+	}{
+		{"int64", []Value{
+			{Type: TYPE_INT64, I64: math.MinInt64},
+			{Type: TYPE_INT64, I64: -1000},
+			{Type: TYPE_INT64, I64: -1},
+			{Type: TYPE_INT64, I64: 0},
+			{Type: TYPE_INT64, I64: 1},
+			{Type: TYPE_INT64, I64: 256},
+			{Type: TYPE_INT64, I64: math.MaxInt64},
+		}},
+		{"float64", []Value{
+			{Type: TYPE_FLOAT64, F64: math.Inf(-1)},
+			{Type: TYPE_FLOAT64, F64: -math.MaxFloat64},
+			{Type: TYPE_FLOAT64, F64: -1.5},
+			{Type: TYPE_FLOAT64, F64: -math.SmallestNonzeroFloat64},
+			{Type: TYPE_FLOAT64, F64: 0},
+			{Type: TYPE_FLOAT64, F64: math.SmallestNonzeroFloat64},
+			{Type: TYPE_FLOAT64, F64: 1},
+			{Type: TYPE_FLOAT64, F64: 1.5},
+			{Type: TYPE_FLOAT64, F64: math.MaxFloat64},
+			{Type: TYPE_FLOAT64, F64: math.Inf(1)},
+		}},
+		{"bool", []Value{
+			{Type: TYPE_BOOL, I64: 0},
+			{Type: TYPE_BOOL, I64: 1},
+		}},
+		{"timestamp", []Value{
+			{Type: TYPE_TIMESTAMP, I64: -1_000_000},
+			{Type: TYPE_TIMESTAMP, I64: 0},
+			{Type: TYPE_TIMESTAMP, I64: 1_700_000_000_000_000},
+		}},
+		{"decimal", []Value{
+			{Type: TYPE_DECIMAL, I64: -10_500_000},
+			{Type: TYPE_DECIMAL, I64: -1},
+			{Type: TYPE_DECIMAL, I64: 0},
+			{Type: TYPE_DECIMAL, I64: 1},
+			{Type: TYPE_DECIMAL, I64: 10_500_000},
+		}},
+		{"bytes", stringValues([][]byte{{}, {0}, []byte("a"), []byte("ab"), {0xff}})},
+		{"json", []Value{
+			{Type: TYPE_JSON, Str: []byte(`"a"`)},
+			{Type: TYPE_JSON, Str: []byte(`[1]`)},
+			{Type: TYPE_JSON, Str: []byte(`{"a":1}`)},
+		}},
+		// the type tag comes first ,NULL sorts before everything
+		{"types", []Value{
+			{Type: TYPE_NULL},
+			{Type: TYPE_BYTES, Str: []byte("z")},
+			{Type: TYPE_INT64, I64: -1},
+			{Type: TYPE_FLOAT64, F64: math.Inf(-1)},
+			{Type: TYPE_BOOL, I64: 0},
+			{Type: TYPE_TIMESTAMP, I64: 0},
+			{Type: TYPE_DECIMAL, I64: 0},
+			{Type: TYPE_JSON, Str: []byte(`null`)},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			checkSorted(t, c.vals)
+		})
+	}
+}
+
+func TestEncodeFloatZero(t *testing.T) {
+	neg := encodeValues(nil, []Value{{Type: TYPE_FLOAT64, F64: math.Copysign(0, -1)}})
+	pos := encodeValues(nil, []Value{{Type: TYPE_FLOAT64, F64: 0}})
+	if !bytes.Equal(neg, pos) {
+		t.Fatalf("-0 and +0 encode differently: %x %x", neg, pos)
+	}
+}
+
+func TestDecodeKey(t *testing.T) {
+	vals := []Value{
+		{Type: TYPE_INT64, I64: -5},
+		{Type: TYPE_BYTES, Str: []byte{0, 'a', 1}},
+		{Type: TYPE_NULL},
+	}
+	key := encodeKey(nil, 7, vals)
+	out := []Value{{Type: TYPE_INT64}, {Type: TYPE_BYTES}, {Type: TYPE_BOOL}}
+	decodeKey(key, out)
+	for i := range vals {
+		if !valueEqual(out[i], vals[i]) {
+			t.Errorf("column %d: got %v ,expected %v", i, out[i], vals[i])
+		}
+	}
+}
+
+// a partial key bounds every full key that starts with it
+func TestEncodeKeyPartial(t *testing.T) {
+	full := encodeKey(nil, 5, []Value{
+		{Type: TYPE_INT64, I64: 1},
+		{Type: TYPE_INT64, I64: 2},
+	})
+	partial := []Value{{Type: TYPE_INT64, I64: 1}}
+	cases := []struct {
+		cmp int
+		ok  bool
+	}{
+		{CMP_GE, true},
+		{CMP_LE, true},
+		{CMP_GT, false},
+		{CMP_LT, false},
+	}
+	for _, c := range cases {
+		ref := encodeKeyPartial(nil, 5, partial, c.cmp)
+		if cmpOK(full, c.cmp, ref) != c.ok {
+			t.Errorf("cmp %d: expected %v", c.cmp, c.ok)
+		}
+	}
+}
+
+// the encoded values are strictly increasing and decode back
+func checkSorted(t *testing.T, vals []Value) {
+	t.Helper()
+	prev := []byte(nil)
+	for i, v := range vals {
+		enc := encodeValues(nil, []Value{v})
+		if i > 0 && bytes.Compare(prev, enc) >= 0 {
+			t.Errorf("%v does not sort after %v", v, vals[i-1])
+		}
+		prev = enc
+
+		out := []Value{{Type: v.Type}}
+		decodeValues(enc, out)
+		if !valueEqual(out[0], v) {
+			t.Errorf("decoded %v ,expected %v", out[0], v)
+		}
+	}
+}
+
+func valueEqual(a, b Value) bool {
+	return a.Type == b.Type && a.I64 == b.I64 && a.F64 == b.F64 && bytes.Equal(a.Str, b.Str)
+}
+
+func FuzzEscapeString(f *testing.F) {
+	f.Add([]byte("abc"), []byte("abd"))
+	f.Add([]byte{0}, []byte{0, 0})
+	f.Add([]byte{1, 0}, []byte{0, 1})
+	f.Add([]byte("a"), []byte{'a', 0})
+	f.Fuzz(func(t *testing.T, a []byte, b []byte) {
+		ea := escapeString(a)
+		if bytes.IndexByte(ea, 0) >= 0 {
+			t.Fatalf("escapeString(%q) = %q has a 0x00", a, ea)
+		}
+		if back := unescapeString(ea); !bytes.Equal(back, a) {
+			t.Fatalf("round trip of %q gives %q", a, back)
+		}
+		// with the terminator ,the order is the order of the strings
+		ka := encodeValues(nil, []Value{{Type: TYPE_BYTES, Str: a}})
+		kb := encodeValues(nil, []Value{{Type: TYPE_BYTES, Str: b}})
+		if bytes.Compare(ka, kb) != bytes.Compare(a, b) {
+			t.Fatalf("order of %q and %q is not kept: %q %q", a, b, ka, kb)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Replica : a follower that applies the change feed of a primary.
+//
+// The replica owns its file (it takes the writer lock) but clients only get
+// read access ,the only writes are the txs coming from the primary.
+// Each record goes through the normal `Begin()`/`Commit()` path ,so the replica's
+// version moves in step with the primary's ,and the version in the meta page
+// is the last applied tx. After a restart we ask the primary to resume from it.
+//
+// To start a replica ,restore a full backup of the primary (see backup.go)
+// and open it with `OpenReplica()`.
+//
+// Wire format of a record :
+// | version | nops | ops... |
+// |   8B    |  4B  |        |
+// op :
+// | deleted | klen | vlen | key | val |
+// |   1B    |  4B  |  4B  | ... | ... |
+
+var ErrReplicaGap = errors.New("replica: missing txs from the primary")
+var ErrReplicaDiverged = errors.New("replica: the data does not match the primary")
+
+type Replica struct {
+	kv KV // not exported ,clients cannot write to it
+}
+
+func OpenReplica(file string, opts Options) (*Replica, error) {
+	if opts.ReadOnly {
+		return nil, errors.New("replica: the file must be writable")
+	}
+	r := &Replica{}
+	r.kv.Path = file
+	r.kv.Options = opts
+	if err := r.kv.Open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Replica) Close() error {
+	return r.kv.Close()
+}
+
+// the last applied version
+func (r *Replica) Version() uint64 {
+	r.kv.mutex.Lock()
+	defer r.kv.mutex.Unlock()
+	return r.kv.version
+}
+
+// read access for clients
+func (r *Replica) Get(key []byte) ([]byte, error) {
+	return r.kv.Get(key)
+}
+
+func (r *Replica) Snapshot() (*KVSnapshot, error) {
+	return r.kv.Snapshot()
+}
+
+// a replica can feed other replicas
+func (r *Replica) Subscribe(from uint64) (*Subscription, error) {
+	return r.kv.Subscribe(from)
+}
+
+// apply 1 committed tx from the primary
+// records are applied in version order ,old ones are skipped so a stream can be replayed
+func (r *Replica) Apply(rec ChangeRecord) error {
+	version := r.Version()
+	if !versionBefore(version, rec.Version) {
+		return nil // already applied
+	}
+	if rec.Version != version+1 {
+		return fmt.Errorf("%w: have %d ,got %d", ErrReplicaGap, version, rec.Version)
+	}
+
+	tx := KVTX{}
+	r.kv.Begin(&tx)
+	// the version is stored in the meta page by the same commit as the data ,
+	// so after a crash we resume from exactly the last applied tx
+	tx.commitAt = rec.Version
+	for _, op := range rec.Ops {
+		ok := false
+		if op.Deleted {
+			ok = tx.Del(&DeleteReq{Key: op.Key})
+		} else {
+			ok = tx.Update(&UpdateReq{Key: op.Key, Val: op.Val, Mode: MODE_UPSERT})
+		}
+		if !ok {
+			// the primary changed the key ,so it must change here too
+			r.kv.Abort(&tx)
+			return fmt.Errorf("%w: version %d: key %q", ErrReplicaDiverged, rec.Version, op.Key)
+		}
+	}
+	if err := r.kv.Commit(&tx); err != nil {
+		return err
+	}
+	if v := r.Version(); v != rec.Version {
+		return fmt.Errorf("%w: have %d after applying %d", ErrReplicaGap, v, rec.Version)
+	}
+	return nil
+}
+
+// apply records from `src` until it ends
+func (r *Replica) Follow(src io.Reader) error {
+	br := bufio.NewReader(src)
+	for {
+		rec, err := readChangeRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := r.Apply(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// connect to a primary started with `ServeReplication()` and follow it
+func (r *Replica) FollowTCP(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("replica: %w", err)
+	}
+	defer conn.Close()
+
+	// tell the primary where to resume from
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], r.Version())
+	if _, err := conn.Write(buf[:]); err != nil {
+		return fmt.Errorf("replica: %w", err)
+	}
+	return r.Follow(conn)
+}
+
+// stream the change feed from version `from` into `w` ,until an error or the kv is closed
+func ServeChanges(kv *KV, from uint64, w io.Writer) error {
+	sub, err := kv.Subscribe(from)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	bw := bufio.NewWriter(w)
+	for {
+		rec, err := sub.Next()
+		if err != nil {
+			return err
+		}
+		if err := writeChangeRecord(bw, rec); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("replication: %w", err)
+		}
+	}
+}
+
+// serve replicas on `ln` ,1 goroutine per connection
+func ServeReplication(kv *KV, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			var buf [8]byte
+			if _, err := io.ReadFull(conn, buf[:]); err != nil {
+				logf(kv, "replication: %v", err)
+				return
+			}
+			from := binary.LittleEndian.Uint64(buf[:])
+			if err := ServeChanges(kv, from, conn); err != nil {
+				logf(kv, "replication: %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func writeChangeRecord(w io.Writer, rec ChangeRecord) error {
+	var hdr [12]byte
+	binary.LittleEndian.PutUint64(hdr[0:], rec.Version)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(rec.Ops)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return fmt.Errorf("replication: %w", err)
+	}
+	for _, op := range rec.Ops {
+		var buf [9]byte
+		if op.Deleted {
+			buf[0] = 1
+		}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(len(op.Key)))
+		binary.LittleEndian.PutUint32(buf[5:], uint32(len(op.Val)))
+		if _, err := w.Write(buf[:]); err != nil {
+			return fmt.Errorf("replication: %w", err)
+		}
+		if _, err := w.Write(op.Key); err != nil {
+			return fmt.Errorf("replication: %w", err)
+		}
+		if _, err := w.Write(op.Val); err != nil {
+			return fmt.Errorf("replication: %w", err)
+		}
+	}
+	return nil
+}
+
+// returns io.EOF only if the stream ends between records
+func readChangeRecord(r io.Reader) (ChangeRecord, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return ChangeRecord{}, io.EOF
+		}
+		return ChangeRecord{}, fmt.Errorf("replication: %w", err)
+	}
+	rec := ChangeRecord{Version: binary.LittleEndian.Uint64(hdr[0:])}
+	nops := binary.LittleEndian.Uint32(hdr[8:])
+	for i := uint32(0); i < nops; i++ {
+		var buf [9]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return ChangeRecord{}, fmt.Errorf("replication: %w", io.ErrUnexpectedEOF)
+		}
+		klen := binary.LittleEndian.Uint32(buf[1:])
+		vlen := binary.LittleEndian.Uint32(buf[5:])
+		if klen > BTREE_MAX_KEY_SIZE || vlen > BTREE_MAX_VALUE_SIZE {
+			return ChangeRecord{}, errors.New("replication: bad record")
+		}
+		op := ChangeOp{Deleted: buf[0] == 1, Key: make([]byte, klen)}
+		if _, err := io.ReadFull(r, op.Key); err != nil {
+			return ChangeRecord{}, fmt.Errorf("replication: %w", io.ErrUnexpectedEOF)
+		}
+		if !op.Deleted {
+			op.Val = make([]byte, vlen)
+			if _, err := io.ReadFull(r, op.Val); err != nil {
+				return ChangeRecord{}, fmt.Errorf("replication: %w", io.ErrUnexpectedEOF)
+			}
+		}
+		rec.Ops = append(rec.Ops, op)
+	}
+	return rec, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestReplica(t *testing.T) *Replica {
+	t.Helper()
+	r, err := OpenReplica(filepath.Join(t.TempDir(), "replica.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// commit some puts and deletes on the primary ,and return its change record
+func commitOps(t *testing.T, kv *KV, sub *Subscription, puts map[string]string, dels []string) ChangeRecord {
+	t.Helper()
+	tx := KVTX{}
+	kv.Begin(&tx)
+	for k, v := range puts {
+		tx.Update(&UpdateReq{Key: []byte(k), Val: []byte(v)})
+	}
+	for _, k := range dels {
+		tx.Del(&DeleteReq{Key: []byte(k)})
+	}
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := sub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestReplicaApply(t *testing.T) {
+	primary := openTestKV(t)
+	sub, err := primary.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	r := openTestReplica(t)
+
+	rec1 := commitOps(t, primary, sub, map[string]string{"a": "1", "b": "2"}, nil)
+	rec2 := commitOps(t, primary, sub, map[string]string{"b": "3"}, []string{"a"})
+
+	// the wire format
+	buf := bytes.Buffer{}
+	for _, rec := range []ChangeRecord{rec1, rec2} {
+		if err := writeChangeRecord(&buf, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Follow(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if v := r.Version(); v != 2 {
+		t.Fatalf("version %d", v)
+	}
+	for key, want := range map[string]string{"a": "", "b": "3"} {
+		if val, _ := r.Get([]byte(key)); string(val) != want {
+			t.Fatalf("%s = %q ,expected %q", key, val, want)
+		}
+	}
+
+	// replayed records are skipped
+	if err := r.Apply(rec1); err != nil {
+		t.Fatal(err)
+	}
+	// a replica can feed another one
+	sub2, err := r.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub2.Close()
+	if got, err := sub2.Next(); err != nil || !reflect.DeepEqual(got, rec2) {
+		t.Fatalf("got %+v %v ,expected %+v", got, err, rec2)
+	}
+}
+
+func TestReplicaErrors(t *testing.T) {
+	r := openTestReplica(t)
+	put := ChangeRecord{Version: 1, Ops: []ChangeOp{{Key: []byte("a"), Val: []byte("1")}}}
+
+	// a missing tx
+	gap := ChangeRecord{Version: 2, Ops: put.Ops}
+	if err := r.Apply(gap); !errors.Is(err, ErrReplicaGap) {
+		t.Fatalf("got %v", err)
+	}
+	if err := r.Apply(put); err != nil {
+		t.Fatal(err)
+	}
+
+	// the primary deleted a key the replica doesnt have
+	del := ChangeRecord{Version: 2, Ops: []ChangeOp{
+		{Key: []byte("a"), Deleted: true},
+		{Key: []byte("b"), Deleted: true},
+	}}
+	if err := r.Apply(del); !errors.Is(err, ErrReplicaDiverged) {
+		t.Fatalf("got %v", err)
+	}
+	// the primary changed a key to the value the replica already has
+	same := ChangeRecord{Version: 2, Ops: put.Ops}
+	if err := r.Apply(same); !errors.Is(err, ErrReplicaDiverged) {
+		t.Fatalf("got %v", err)
+	}
+	// nothing was applied
+	if val, _ := r.Get([]byte("a")); r.Version() != 1 || string(val) != "1" {
+		t.Fatalf("version %d ,a = %q", r.Version(), val)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import "errors"
+
+// A snapshot is a read-only view of the database at a point in time.
+// Because of copy-on-write ,an old root stays valid as long as its pages are not reused,
+// so a snapshot just has to remember the root and stop the free list from
+// handing out pages freed after its version (see `oldestReader()`).
+//
+// Unlike a `KVTX` it can be kept open for a long time ,eg for a backup
+// or for running multiple queries against the same data.
+// Keeping it open makes the file grow ,freed pages pile up until it is closed.
+
+var ErrSnapshotClosed = errors.New("snapshot is closed")
+
+type KVSnapshot struct {
+	db      *KV
+	tree    BTree  // read only ,points to the root at the time of the snapshot
+	version uint64 // based on KV.version
+	pages   uint64 // file size in pages ,every page of the tree is below this
+	closed  bool
+}
+
+// pin the current root and version
+func (kv *KV) Snapshot() (*KVSnapshot, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if kv.closed {
+		return nil, ErrClosed
+	}
+
+	snap := &KVSnapshot{db: kv, version: kv.version, pages: kv.page.flushed}
+	snap.tree.root = kv.tree.root
+	chunks := kv.mmap.chunks // copied to avoid updates from writers
+	snap.tree.get = func(ptr uint64) []byte { return mmapRead(ptr, chunks) }
+	// the tree is never modified through a snapshot
+	snap.tree.new = func([]byte) uint64 { panic("write to a snapshot") }
+	snap.tree.del = func(uint64) { panic("write to a snapshot") }
+
+	// registered like a tx ,this holds back page reuse
+	kv.ongoing = append(kv.ongoing, snap.version)
+	return snap, nil
+}
+
+// the version of the data this snapshot sees
+func (snap *KVSnapshot) Version() uint64 {
+	return snap.version
+}
+
+func (snap *KVSnapshot) Get(key []byte) ([]byte, bool, error) {
+	if snap.closed || snap.db.closed {
+		return nil, false, ErrSnapshotClosed // the mmap is gone after `KV.Close()`
+	}
+	val, ok := snap.tree.Get(key)
+	return val, ok, nil
+}
+
+// iterate from `key` ,see `CMP_*`
+func (snap *KVSnapshot) Seek(key []byte, cmp int) (*BIter, error) {
+	if snap.closed || snap.db.closed {
+		return nil, ErrSnapshotClosed
+	}
+	return snap.tree.Seek(key, cmp), nil
+}
+
+// release the snapshot so its pages can be reused by later updates
+func (snap *KVSnapshot) Close() {
+	kv := snap.db
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if snap.closed {
+		return
+	}
+	snap.closed = true
+	removeReader(kv, snap.version)
+	dropHistory(kv)
+}
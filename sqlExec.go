@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Executing the write statements of the query language ,in a `DBTX`.
+// INSERT ,UPDATE and DELETE return the number of rows they changed.
+//
+// UPDATE and DELETE find their rows with `qlScanIter` (INDEX BY ,FILTER ,LIMIT),
+// the rows are read in full before the first write ,the writes would invalidate the scan.
+
+// run a statement in a new tx
+func (db *DB) Exec(sql string) (uint64, error) {
+	stmt, err := ParseStmt(sql)
+	if err != nil {
+		return 0, err
+	}
+	tx := DBTX{}
+	db.Begin(&tx)
+	count, err := tx.Exec(stmt)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	if err := db.Commit(&tx); err != nil {
+		return 0, err // nothing was changed
+	}
+	return count, nil
+}
+
+// run a parsed statement ,from `ParseStmt()`
+func (tx *DBTX) Exec(stmt interface{}) (uint64, error) {
+	switch stmt := stmt.(type) {
+	case *QLCreateTable:
+		return 0, tx.TableNew(&stmt.Def)
+	case *QLInsert:
+		return qlInsert(tx, stmt)
+	case *QLUpdate:
+		return qlUpdate(tx, stmt)
+	case *QLDelete:
+		return qlDelete(tx, stmt)
+	default:
+		return 0, fmt.Errorf("not a write statement: %T", stmt)
+	}
+}
+
+func qlInsert(tx *DBTX, stmt *QLInsert) (uint64, error) {
+	tdef, err := findTableDef(tx, stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	count := uint64(0)
+	for _, row := range stmt.Values {
+		rec := Record{Cols: stmt.Names}
+		for i, expr := range row {
+			ctx := QLEvalContex{} // no columns
+			qlEval(&ctx, expr)
+			if ctx.err != nil {
+				return count, ctx.err
+			}
+			v, err := qlColumnValue(tdef, stmt.Names[i], ctx.out)
+			if err != nil {
+				return count, err
+			}
+			rec.Vals = append(rec.Vals, v)
+		}
+
+		if stmt.Mode == MODE_INSERT_ONLY {
+			// fails on duplicates ,and assigns auto-increment ids
+			if _, err := tx.Insert(stmt.Table, rec); err != nil {
+				return count, err
+			}
+			count++
+			continue
+		}
+		updated, err := tx.Set(stmt.Table, rec, stmt.Mode)
+		if err != nil {
+			return count, err
+		}
+		if updated {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func qlUpdate(tx *DBTX, stmt *QLUpdate) (uint64, error) {
+	tdef, err := findTableDef(tx, stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	for _, col := range stmt.Names {
+		idx := slices.Index(tdef.Cols, col)
+		if idx < 0 {
+			return 0, fmt.Errorf("table %s: unknown column: %s", tdef.Name, col)
+		}
+		if idx < tdef.Pkeys {
+			return 0, fmt.Errorf("table %s: cannot update the primary key column %s", tdef.Name, col)
+		}
+	}
+	rows, err := qlScanRows(tx, &stmt.QLScan)
+	if err != nil {
+		return 0, err
+	}
+
+	count := uint64(0)
+	for _, row := range rows {
+		// the expressions see the old row
+		ctx := QLEvalContex{env: row}
+		vals := slices.Clone(row.Vals)
+		for i, expr := range stmt.Values {
+			qlEval(&ctx, expr)
+			if ctx.err != nil {
+				return count, ctx.err
+			}
+			v, err := qlColumnValue(tdef, stmt.Names[i], ctx.out)
+			if err != nil {
+				return count, err
+			}
+			vals[slices.Index(row.Cols, stmt.Names[i])] = v
+		}
+		updated, err := dbSet(tx, tdef, Record{Cols: row.Cols, Vals: vals}, MODE_UPDATE_ONLY)
+		if err != nil {
+			return count, err
+		}
+		if updated {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// a value for a column ,a number is converted to the column type (eg 1 to a FLOAT64)
+func qlColumnValue(tdef *TableDef, col string, v Value) (Value, error) {
+	idx := slices.Index(tdef.Cols, col)
+	if idx < 0 {
+		return v, nil // reported by `checkRecord()`
+	}
+	out, ok := convertValue(v, tdef.Types[idx])
+	if !ok {
+		return v, fmt.Errorf("table %s: column %s: cannot store a %s value in a %s column",
+			tdef.Name, col, qlTypeName(v.Type), qlTypeName(tdef.Types[idx]))
+	}
+	return out, nil
+}
+
+func qlDelete(tx *DBTX, stmt *QLDelete) (uint64, error) {
+	tdef, err := findTableDef(tx, stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := qlScanRows(tx, &stmt.QLScan)
+	if err != nil {
+		return 0, err
+	}
+	count := uint64(0)
+	for _, row := range rows {
+		key := Record{Cols: row.Cols[:tdef.Pkeys], Vals: row.Vals[:tdef.Pkeys]}
+		// a cascade may have deleted it already
+		deleted, err := fkDelete(tx, tdef, key)
+		if err != nil {
+			return count, err
+		}
+		if deleted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// all the rows of a scan
+func qlScanRows(tx *DBTX, req *QLScan) ([]Record, error) {
+	iter, err := qlScan(tx, req)
+	if err != nil {
+		return nil, err
+	}
+	rows := []Record(nil)
+	for ; iter.Valid(); iter.Next() {
+		rec := Record{}
+		if err := iter.deref(&rec); err != nil {
+			return nil, err
+		}
+		rows = append(rows, rec)
+	}
+	return rows, nil
+}
+
+// start a scan ,positioned on the 1st row
+func qlScan(tx *DBTX, req *QLScan) (*qlScanIter, error) {
+	iter := &qlScanIter{req: req}
+	if err := qlScanInit(req, &iter.sc); err != nil {
+		return nil, err
+	}
+	if err := tx.Scan(req.Table, &iter.sc); err != nil {
+		return nil, err
+	}
+	iter.pull()
+	return iter, nil
+}
+
+func (iter *qlScanIter) Valid() bool {
+	return !iter.end
+}
+
+func (iter *qlScanIter) Next() {
+	if iter.err != nil {
+		iter.end = true
+		return
+	}
+	iter.sc.Next()
+	iter.pull()
+}
+
+// the current row ,without `@rowid`
+func (iter *qlScanIter) Deref(rec *Record) error {
+	if err := iter.deref(rec); err != nil {
+		return err
+	}
+	userRecord(rec)
+	return nil
+}
+
+// the full row ,for UPDATE and DELETE
+func (iter *qlScanIter) deref(rec *Record) error {
+	if iter.err != nil {
+		return iter.err
+	}
+	*rec = iter.rec
+	return nil
+}
+
+// move to the next row that passes the filter ,from the current position
+// `idx` counts the rows that passed ,the first `Offset` ones are skipped
+func (iter *qlScanIter) pull() {
+	req := iter.req
+	for ; iter.sc.Valid(); iter.sc.Next() {
+		if iter.idx >= req.Offset && iter.idx-req.Offset >= req.Limit {
+			break // LIMIT reached
+		}
+		rec := Record{}
+		if iter.err = iter.sc.deref(&rec); iter.err != nil { // with `@rowid` ,to update the row
+			return
+		}
+		if req.Filter.Type != QL_UNINIT {
+			ctx := QLEvalContex{env: rec}
+			qlEval(&ctx, req.Filter)
+			if iter.err = ctx.err; iter.err != nil {
+				return
+			}
+			if !qlIsTrue(ctx.out) {
+				continue
+			}
+		}
+		iter.idx++
+		if iter.idx <= req.Offset {
+			continue
+		}
+		rec.Vals = slices.Clone(rec.Vals)
+		iter.rec = rec
+		return
+	}
+	iter.end = true
+}
+
+// `a > 1` ,`(a, b) = (1, 2)` to a scanner key
+func qlEvalScanKey(node QLNode) (Record, int, error) {
+	key := Record{}
+	cmp := 0
+	switch node.Type {
+	case QL_UNINIT:
+		return key, 0, nil // no key
+	case QL_CMP_GE, QL_CMP_EQ:
+		cmp = CMP_GE // `=` is made a range by `qlScanInit()`
+	case QL_CMP_GT:
+		cmp = CMP_GT
+	case QL_CMP_LT:
+		cmp = CMP_LT
+	case QL_CMP_LE:
+		cmp = CMP_LE
+	default:
+		panic("unreachable") // checked by `pVerifyScanKey()`
+	}
+
+	cols, vals := []QLNode{node.Kids[0]}, []QLNode{node.Kids[1]}
+	if node.Kids[0].Type == QL_TUP {
+		cols = node.Kids[0].Kids
+		if node.Kids[1].Type != QL_TUP || len(node.Kids[1].Kids) != len(cols) {
+			return key, 0, fmt.Errorf("`INDEX BY`: columns and values dont match")
+		}
+		vals = node.Kids[1].Kids
+	}
+	for i, col := range cols {
+		ctx := QLEvalContex{} // no columns
+		qlEval(&ctx, vals[i])
+		if ctx.err != nil {
+			return key, 0, ctx.err
+		}
+		name, _ := qlIndexColumn(col) // checked by `pVerifyScanKey()`
+		key.Cols = append(key.Cols, name)
+		key.Vals = append(key.Vals, ctx.out)
+	}
+	return key, cmp, nil
+}
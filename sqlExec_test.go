@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExecWrites(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `create table t (id int64, v int64, primary key (id))`)
+
+	cases := []struct {
+		sql   string
+		count uint64
+	}{
+		{`insert into t (id, v) values (1, 1), (2, 2)`, 2},
+		// UPSERT inserts or changes ,an identical row is not a change
+		{`upsert into t (id, v) values (2, 2), (3, 3)`, 1},
+		{`upsert into t (id, v) values (2, 20)`, 1},
+		// REPLACE only changes existing rows
+		{`replace into t (id, v) values (3, 30), (4, 4)`, 1},
+		{`update t set v = v + 1 filter id >= 2`, 2},
+		{`update t set v = 1 filter id = 1`, 0}, // the same value
+		{`delete from t filter v > 20`, 2},
+		{`delete from t filter id = 9`, 0},
+	}
+	for _, c := range cases {
+		if n := mustExec(t, db, c.sql); n != c.count {
+			t.Errorf("%s: got %d ,expected %d", c.sql, n, c.count)
+		}
+	}
+	want := map[int64]int64{1: 1}
+	for id := int64(1); id <= 4; id++ {
+		rec := *(&Record{}).AddInt64("id", id)
+		ok, err := db.Get("t", &rec)
+		if v, exists := want[id]; err != nil || ok != exists || (ok && rec.Get("v").I64 != v) {
+			t.Errorf("id %d: got %v %v %+v", id, ok, err, rec)
+		}
+	}
+
+	// INSERT fails on a duplicate ,and the statement changes nothing
+	_, err := db.Exec(`insert into t (id, v) values (5, 5), (1, 1)`)
+	cerr := (*ConstraintError)(nil)
+	if !errors.As(err, &cerr) {
+		t.Fatalf("got %v", err)
+	}
+	rec := *(&Record{}).AddInt64("id", 5)
+	if ok, _ := db.Get("t", &rec); ok {
+		t.Fatal("a failed statement was committed")
+	}
+}
+
+// no rows are reported when the commit fails
+func TestExecCommitError(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `create table t (id int64, primary key (id))`)
+	reader := &DB{}
+	reader.kv.Path = db.kv.Path
+	reader.kv.Options.ReadOnly = true
+	if err := reader.kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer reader.kv.Close()
+	n, err := reader.Exec(`insert into t (id) values (1)`)
+	if n != 0 || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("got %d %v", n, err)
+	}
+}
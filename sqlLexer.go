@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tokenizer and parser state for the query language.
+//
+// The input is split into tokens first ,the parser functions (`p*`) then
+// walk the token list. Keywords are plain symbols ,matched case-insensitively.
+//   - symbols : [A-Za-z_][A-Za-z0-9_]*
+//   - strings : 'abc' or "abc" ,with the escapes \' \" \\ \n \r \t \0 \xHH
+//   - numbers : 123 ,1.5 (no sign ,the minus is an operator)
+//   - comments : -- to the end of the line ,/* ... */
+// The 1st error (from the tokenizer or the parser) is kept with its line and column,
+// the parser stops matching anything after it.
+
+const (
+	TOK_EOF   = 0
+	TOK_SYM   = 1 // identifier or keyword
+	TOK_STR   = 2 // quoted string ,unescaped in `Str`
+	TOK_INT   = 3 // in `I64`
+	TOK_FLOAT = 4 // in `F64`
+	TOK_OP    = 5 // operator or punctuation
+)
+
+type Token struct {
+	Type  int
+	Text  string // the source text ,except for strings
+	Str   []byte
+	I64   int64
+	F64   float64
+	Start int // offsets in the input
+	End   int
+	Line  int // 1-based
+	Col   int // 1-based ,in bytes
+}
+
+type Parser struct {
+	input []byte
+	toks  []Token // ends with TOK_EOF
+	idx   int     // the next token
+	err   error
+	pos   lexPos // for `position()`
+}
+
+// the line of an offset ,the newlines before it are counted
+type lexPos struct {
+	off       int
+	line      int // 1-based
+	lineStart int // the offset of the line
+}
+
+// operators ,the longer ones first
+var qlOperators = []string{
+	"->>", "->", ">=", "<=", "!=", "<>",
+	"=", "<", ">", "+", "-", "*", "/", "%", "(", ")", ",", ";", ".",
+}
+
+func NewParser(input string) *Parser {
+	p := &Parser{input: []byte(input), pos: lexPos{line: 1}}
+	lex(p)
+	return p
+}
+
+// the position of an offset ,for tokens and errors
+// the lexer only asks for later offsets ,so each newline is counted once
+func (p *Parser) position(off int) (int, int) {
+	if off < p.pos.off {
+		p.pos = lexPos{line: 1} // start over
+	}
+	for ; p.pos.off < off; p.pos.off++ {
+		if p.input[p.pos.off] == '\n' {
+			p.pos.line++
+			p.pos.lineStart = p.pos.off + 1
+		}
+	}
+	return p.pos.line, off - p.pos.lineStart + 1
+}
+
+// record the 1st error ,at the current token
+func pErr(p *Parser, format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	tok := p.toks[min(p.idx, len(p.toks)-1)]
+	p.err = fmt.Errorf("parse error at %d:%d: %s", tok.Line, tok.Col, fmt.Sprintf(format, args...))
+}
+
+func lexErr(p *Parser, off int, format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	line, col := p.position(off)
+	p.err = fmt.Errorf("parse error at %d:%d: %s", line, col, fmt.Sprintf(format, args...))
+}
+
+func isSymStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// split the whole input ,stops at the 1st error with a TOK_EOF
+func lex(p *Parser) {
+	in := p.input
+	pos := 0
+	for {
+		// spaces and comments
+		for p.err == nil && pos < len(in) {
+			switch {
+			case in[pos] == ' ' || in[pos] == '\t' || in[pos] == '\n' || in[pos] == '\r':
+				pos++
+				continue
+			case bytes.HasPrefix(in[pos:], []byte("--")):
+				for pos < len(in) && in[pos] != '\n' {
+					pos++
+				}
+				continue
+			case bytes.HasPrefix(in[pos:], []byte("/*")):
+				end := bytes.Index(in[pos+2:], []byte("*/"))
+				if end < 0 {
+					lexErr(p, pos, "unterminated comment")
+					pos = len(in)
+					break
+				}
+				pos += 2 + end + 2
+				continue
+			}
+			break
+		}
+
+		tok := Token{Start: pos}
+		tok.Line, tok.Col = p.position(pos)
+		switch {
+		case p.err != nil || pos >= len(in):
+			tok.Type, pos = TOK_EOF, len(in)
+		case isSymStart(in[pos]):
+			for pos < len(in) && (isSymStart(in[pos]) || isDigit(in[pos])) {
+				pos++
+			}
+			tok.Type = TOK_SYM
+		case isDigit(in[pos]):
+			pos = lexNumber(p, &tok, pos)
+		case in[pos] == '\'' || in[pos] == '"':
+			pos = lexString(p, &tok, pos)
+		default:
+			for _, op := range qlOperators {
+				if bytes.HasPrefix(in[pos:], []byte(op)) {
+					tok.Type = TOK_OP
+					pos += len(op)
+					break
+				}
+			}
+			if tok.Type != TOK_OP {
+				lexErr(p, pos, "unexpected character %q", in[pos])
+				tok.Type = TOK_EOF
+			}
+		}
+		tok.End = pos
+		tok.Text = string(in[tok.Start:tok.End])
+		p.toks = append(p.toks, tok)
+		if tok.Type == TOK_EOF {
+			return
+		}
+	}
+}
+
+func lexNumber(p *Parser, tok *Token, pos int) int {
+	in := p.input
+	start := pos
+	for pos < len(in) && isDigit(in[pos]) {
+		pos++
+	}
+	float := pos+1 < len(in) && in[pos] == '.' && isDigit(in[pos+1])
+	if float {
+		pos++
+		for pos < len(in) && isDigit(in[pos]) {
+			pos++
+		}
+	}
+	if pos < len(in) && isSymStart(in[pos]) {
+		lexErr(p, pos, "bad number")
+		return pos
+	}
+	var err error
+	if float {
+		tok.Type = TOK_FLOAT
+		tok.F64, err = strconv.ParseFloat(string(in[start:pos]), 64)
+	} else {
+		tok.Type = TOK_INT
+		tok.I64, err = strconv.ParseInt(string(in[start:pos]), 10, 64)
+	}
+	if err != nil {
+		lexErr(p, start, "bad number: %s", in[start:pos])
+	}
+	return pos
+}
+
+func lexString(p *Parser, tok *Token, pos int) int {
+	in := p.input
+	quote := in[pos]
+	start := pos
+	pos++
+	tok.Type = TOK_STR
+	tok.Str = []byte{}
+	for {
+		if pos >= len(in) {
+			lexErr(p, start, "unterminated string")
+			return pos
+		}
+		ch := in[pos]
+		pos++
+		if ch == quote {
+			return pos
+		}
+		if ch != '\\' {
+			tok.Str = append(tok.Str, ch)
+			continue
+		}
+		if pos >= len(in) {
+			lexErr(p, start, "unterminated string")
+			return pos
+		}
+		esc := in[pos]
+		pos++
+		switch esc {
+		case '\'', '"', '\\':
+			tok.Str = append(tok.Str, esc)
+		case 'n':
+			tok.Str = append(tok.Str, '\n')
+		case 'r':
+			tok.Str = append(tok.Str, '\r')
+		case 't':
+			tok.Str = append(tok.Str, '\t')
+		case '0':
+			tok.Str = append(tok.Str, 0)
+		case 'x':
+			if pos+2 > len(in) {
+				lexErr(p, pos-2, "bad escape")
+				return pos
+			}
+			b, err := strconv.ParseUint(string(in[pos:pos+2]), 16, 8)
+			if err != nil {
+				lexErr(p, pos-2, "bad escape")
+				return pos
+			}
+			tok.Str = append(tok.Str, byte(b))
+			pos += 2
+		default:
+			lexErr(p, pos-2, "bad escape: \\%c", esc)
+			return pos
+		}
+	}
+}
+
+// the next token
+func pPeek(p *Parser) *Token {
+	return &p.toks[p.idx]
+}
+
+// consume the next token ,EOF stays
+func pNext(p *Parser) *Token {
+	tok := &p.toks[p.idx]
+	if tok.Type != TOK_EOF {
+		p.idx++
+	}
+	return tok
+}
+
+// match a sequence of keywords or operators ,consume them only if all match
+func pKeyword(p *Parser, kwds ...string) bool {
+	if p.err != nil {
+		return false
+	}
+	for i, kw := range kwds {
+		if p.idx+i >= len(p.toks) {
+			return false
+		}
+		tok := &p.toks[p.idx+i]
+		switch tok.Type {
+		case TOK_SYM:
+			if !strings.EqualFold(tok.Text, kw) {
+				return false
+			}
+		case TOK_OP:
+			if tok.Text != kw {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	p.idx += len(kwds)
+	return true
+}
+
+func pExpect(p *Parser, kwd string, msg string) {
+	if !pKeyword(p, kwd) {
+		pErr(p, "%s", msg)
+	}
+}
+
+// words that cannot be a table or column name
+var qlReserved = []string{
+	"select", "from", "index", "by", "filter", "limit", "and", "or", "not",
+	"is", "null", "true", "false", "as", "create", "table",
+	"insert", "upsert", "replace", "into", "values", "update", "set", "delete",
+	// CREATE TABLE ,eg a column `key` would be taken for `PRIMARY KEY`
+	"primary", "key", "unique", "check", "default", "constraint", "foreign", "references",
+}
+
+func isReserved(word string) bool {
+	for _, kw := range qlReserved {
+		if strings.EqualFold(word, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// a name ,not a keyword
+func pSym(p *Parser, name *string) bool {
+	tok := pPeek(p)
+	if p.err != nil || tok.Type != TOK_SYM || isReserved(tok.Text) {
+		return false
+	}
+	*name = pNext(p).Text
+	return true
+}
+
+func pMustSym(p *Parser) string {
+	name := ""
+	if !pSym(p, &name) {
+		pErr(p, "expect name")
+	}
+	return name
+}
+
+// the end of the input ,after an optional `;`
+func pEnd(p *Parser) bool {
+	pKeyword(p, ";")
+	return p.err == nil && pPeek(p).Type == TOK_EOF
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLexTokens(t *testing.T) {
+	type tok struct {
+		typ  int
+		text string
+		line int
+		col  int
+	}
+	cases := []struct {
+		in   string
+		toks []tok
+	}{
+		{"", nil},
+		{"select a, b_1 from t;", []tok{
+			{TOK_SYM, "select", 1, 1},
+			{TOK_SYM, "a", 1, 8},
+			{TOK_OP, ",", 1, 9},
+			{TOK_SYM, "b_1", 1, 11},
+			{TOK_SYM, "from", 1, 15},
+			{TOK_SYM, "t", 1, 20},
+			{TOK_OP, ";", 1, 21},
+		}},
+		{"a>=1 and b<>2.5", []tok{
+			{TOK_SYM, "a", 1, 1},
+			{TOK_OP, ">=", 1, 2},
+			{TOK_INT, "1", 1, 4},
+			{TOK_SYM, "and", 1, 6},
+			{TOK_SYM, "b", 1, 10},
+			{TOK_OP, "<>", 1, 11},
+			{TOK_FLOAT, "2.5", 1, 13},
+		}},
+		{"doc->'a'->>'b'", []tok{
+			{TOK_SYM, "doc", 1, 1},
+			{TOK_OP, "->", 1, 4},
+			{TOK_STR, "'a'", 1, 6},
+			{TOK_OP, "->>", 1, 9},
+			{TOK_STR, "'b'", 1, 12},
+		}},
+		// the minus is an operator ,`1.` is not a float
+		{"-1.x", []tok{
+			{TOK_OP, "-", 1, 1},
+			{TOK_INT, "1", 1, 2},
+			{TOK_OP, ".", 1, 3},
+			{TOK_SYM, "x", 1, 4},
+		}},
+		// comments and lines
+		{"a -- comment\n  b /* multi\nline */ c\r\n\td", []tok{
+			{TOK_SYM, "a", 1, 1},
+			{TOK_SYM, "b", 2, 3},
+			{TOK_SYM, "c", 3, 9},
+			{TOK_SYM, "d", 4, 2},
+		}},
+		// a string with a newline moves the lines after it
+		{"'x\ny' z", []tok{
+			{TOK_STR, "'x\ny'", 1, 1},
+			{TOK_SYM, "z", 2, 4},
+		}},
+	}
+	for _, c := range cases {
+		p := NewParser(c.in)
+		if p.err != nil {
+			t.Errorf("%q: %v", c.in, p.err)
+			continue
+		}
+		got := p.toks[:len(p.toks)-1]
+		if len(got) != len(c.toks) || p.toks[len(p.toks)-1].Type != TOK_EOF {
+			t.Errorf("%q: got %d tokens ,expected %d", c.in, len(got), len(c.toks))
+			continue
+		}
+		for i, want := range c.toks {
+			g := got[i]
+			if g.Type != want.typ || g.Text != want.text || g.Line != want.line || g.Col != want.col {
+				t.Errorf("%q: token %d is %d %q at %d:%d ,expected %d %q at %d:%d", c.in, i,
+					g.Type, g.Text, g.Line, g.Col, want.typ, want.text, want.line, want.col)
+			}
+		}
+	}
+}
+
+func TestLexValues(t *testing.T) {
+	p := NewParser("123 0 9223372036854775807 1.5 0.25")
+	if p.err != nil {
+		t.Fatal(p.err)
+	}
+	ints := []int64{123, 0, 9223372036854775807}
+	for i, v := range ints {
+		if p.toks[i].Type != TOK_INT || p.toks[i].I64 != v {
+			t.Errorf("token %d: expected %d ,got %+v", i, v, p.toks[i])
+		}
+	}
+	floats := []float64{1.5, 0.25}
+	for i, v := range floats {
+		tok := p.toks[len(ints)+i]
+		if tok.Type != TOK_FLOAT || tok.F64 != v {
+			t.Errorf("token %d: expected %v ,got %+v", len(ints)+i, v, tok)
+		}
+	}
+}
+
+func TestLexEscapes(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []byte
+	}{
+		{`''`, []byte{}},
+		{`""`, []byte{}},
+		{`'abc'`, []byte("abc")},
+		{`"it's"`, []byte("it's")},
+		{`'say "hi"'`, []byte(`say "hi"`)},
+		{`'\'\"\\'`, []byte(`'"\`)},
+		{`'a\nb\rc\td'`, []byte("a\nb\rc\td")},
+		{`'\0\x01\xff\x4A'`, []byte{0, 1, 0xff, 'J'}},
+	}
+	for _, c := range cases {
+		p := NewParser(c.in)
+		if p.err != nil {
+			t.Errorf("%s: %v", c.in, p.err)
+			continue
+		}
+		tok := p.toks[0]
+		if tok.Type != TOK_STR || !bytes.Equal(tok.Str, c.out) || len(p.toks) != 2 {
+			t.Errorf("%s: got %q ,expected %q", c.in, tok.Str, c.out)
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	cases := []struct {
+		in  string
+		err string
+	}{
+		{"a ? b", "parse error at 1:3: unexpected character '?'"},
+		{"a\n  'abc", "parse error at 2:3: unterminated string"},
+		{"'abc\\", "parse error at 1:1: unterminated string"},
+		{"x = 'a\\qb'", "parse error at 1:7: bad escape: \\q"},
+		{"'\\x4'", "parse error at 1:2: bad escape"},
+		{"'\\xZZ'", "parse error at 1:2: bad escape"},
+		{"a\nb /* never closed", "parse error at 2:3: unterminated comment"},
+		{"\n\n  12ab", "parse error at 3:5: bad number"},
+		{"99999999999999999999", "parse error at 1:1: bad number: 99999999999999999999"},
+	}
+	for _, c := range cases {
+		p := NewParser(c.in)
+		if p.err == nil || p.err.Error() != c.err {
+			t.Errorf("%q: got error %v ,expected %q", c.in, p.err, c.err)
+		}
+		if last := p.toks[len(p.toks)-1]; last.Type != TOK_EOF {
+			t.Errorf("%q: the tokens dont end with EOF", c.in)
+		}
+	}
+}
+
+// a parse error is reported at the current token
+func TestParseErrorPosition(t *testing.T) {
+	p := NewParser("select a\n  from t\n  limit x")
+	for i := 0; i < 5; i++ {
+		pNext(p)
+	}
+	pErr(p, "expect a number")
+	want := "parse error at 3:9: expect a number"
+	if p.err == nil || p.err.Error() != want {
+		t.Fatalf("got %v ,expected %q", p.err, want)
+	}
+	// only the 1st error is kept
+	pErr(p, "another")
+	if p.err.Error() != want {
+		t.Fatalf("the 1st error was replaced: %v", p.err)
+	}
+}
+
+// a long input is lexed in linear time ,the positions are still right
+func TestLexLongInput(t *testing.T) {
+	const lines = 100000
+	in := strings.Repeat("abc = 'x',\n", lines)
+	p := NewParser(in)
+	if p.err != nil {
+		t.Fatal(p.err)
+	}
+	if n := len(p.toks); n != 4*lines+1 {
+		t.Fatalf("got %d tokens", n)
+	}
+	last := p.toks[len(p.toks)-2]
+	if last.Line != lines || last.Col != 10 {
+		t.Fatalf("the last token is at %d:%d", last.Line, last.Col)
+	}
+}
@@ -1,16 +1,62 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"fmt"
 	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type QLNode struct {
-	Type uint32 // tagged union
-	I64  int64
-	Str  []byte
-	Kids []QLNode // operands
+	Value           // Type ,I64 ,Str ; the type is one of `QL_*`
+	Kids   []QLNode // operands
 }
 
+// node types ,the literals share the values of `TYPE_*` ,except NULL
+const (
+	QL_UNINIT = 0 // no expression ,eg no `FILTER`
+	// scalars
+	QL_NULL      = 9 // not TYPE_NULL ,it would be QL_UNINIT ,evaluates to TYPE_NULL
+	QL_STR       = TYPE_BYTES
+	QL_I64       = TYPE_INT64
+	QL_F64       = TYPE_FLOAT64
+	QL_BOOL      = TYPE_BOOL
+	QL_TIMESTAMP = TYPE_TIMESTAMP
+	QL_DECIMAL   = TYPE_DECIMAL
+	// binary ops
+	QL_CMP_GE = 10 // >=
+	QL_CMP_GT = 11 // >
+	QL_CMP_LT = 12 // <
+	QL_CMP_LE = 13 // <=
+	QL_CMP_EQ = 14 // =
+	QL_CMP_NE = 15 // !=
+	QL_ADD    = 20
+	QL_SUB    = 21
+	QL_MUL    = 22
+	QL_DIV    = 23
+	QL_MOD    = 24
+	QL_AND    = 30
+	QL_OR     = 31
+	// unary ops
+	QL_NOT      = 50
+	QL_NEG      = 51
+	QL_IS_NULL  = 52 // x IS NULL
+	QL_NOT_NULL = 53 // x IS NOT NULL
+	// JSON paths
+	QL_JSON_GET  = 60 // doc -> 'key' ,the JSON value
+	QL_JSON_TEXT = 61 // doc ->> 'key' ,the value as text
+	// others
+	QL_SYM  = 100 // column
+	QL_TUP  = 101 // tuple
+	QL_STAR = 102 // select *
+	QL_ERR  = 200 // error; from parsing or evaluation
+)
+
 //  statements : select,update,delete
 
 type QLSelect struct {
@@ -28,6 +74,18 @@ type QLDelete struct {
 	QLScan
 }
 
+// INSERT ,UPSERT or REPLACE
+type QLInsert struct {
+	Table  string
+	Mode   int // MODE_INSERT_ONLY ,MODE_UPSERT or MODE_UPDATE_ONLY
+	Names  []string
+	Values [][]QLNode // rows
+}
+
+type QLCreateTable struct {
+	Def TableDef
+}
+
 // common structure for statements : `INDEX BY`,`FILTER`,`LIMIT`
 
 type QLScan struct {
@@ -45,16 +103,102 @@ type QLEvalContex struct {
 	err error  // any error that occurs during evaluation (column or type mismatch)
 }
 
+// parse 1 statement ,errors have the line and column
+func ParseStmt(sql string) (interface{}, error) {
+	p := NewParser(sql)
+	stmt := pStmt(p)
+	if stmt == nil {
+		pErr(p, "unknown statement")
+	}
+	if !pEnd(p) {
+		if tok := pPeek(p); tok.Type == TOK_EOF {
+			pErr(p, "unexpected end of input")
+		} else {
+			pErr(p, "unexpected %q", tok.Text)
+		}
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return stmt, nil
+}
+
 func pStmt(p *Parser) (r interface{}) {
 	switch {
 	case pKeyword(p, "create", "table"):
 		r = pCreateTable(p)
 	case pKeyword(p, "select"):
 		r = pSelect(p)
+	case pKeyword(p, "insert", "into"):
+		r = pInsert(p, MODE_INSERT_ONLY)
+	case pKeyword(p, "upsert", "into"):
+		r = pInsert(p, MODE_UPSERT)
+	case pKeyword(p, "replace", "into"):
+		r = pInsert(p, MODE_UPDATE_ONLY)
+	case pKeyword(p, "update"):
+		r = pUpdate(p)
+	case pKeyword(p, "delete", "from"):
+		r = pDelete(p)
 	}
 	return r
 }
 
+// INSERT INTO t (a, b) VALUES (1, 2), (3, 4)
+func pInsert(p *Parser, mode int) *QLInsert {
+	stmt := QLInsert{Mode: mode}
+	stmt.Table = pMustSym(p)
+	stmt.Names = pNameList(p)
+	pExpect(p, "values", "expect `VALUES`")
+	for p.err == nil {
+		pExpect(p, "(", "expect `(`")
+		row := []QLNode(nil)
+		for p.err == nil {
+			expr := QLNode{}
+			pExprOr(p, &expr)
+			row = append(row, expr)
+			if !pKeyword(p, ",") {
+				break
+			}
+		}
+		pExpect(p, ")", "expect `)`")
+		if p.err == nil && len(row) != len(stmt.Names) {
+			pErr(p, "expect %d values ,got %d", len(stmt.Names), len(row))
+		}
+		stmt.Values = append(stmt.Values, row)
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	return &stmt
+}
+
+// UPDATE t SET a = 1, b = b + 1 INDEX BY xx FILTER yy LIMIT zz
+func pUpdate(p *Parser) *QLUpdate {
+	stmt := QLUpdate{}
+	stmt.Table = pMustSym(p)
+	pExpect(p, "set", "expect `SET`")
+	for p.err == nil {
+		stmt.Names = append(stmt.Names, pMustSym(p))
+		pExpect(p, "=", "expect `=`")
+		expr := QLNode{}
+		pExprOr(p, &expr)
+		stmt.Values = append(stmt.Values, expr)
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	pScan(p, &stmt.QLScan)
+	return &stmt
+}
+
+// DELETE FROM t INDEX BY xx FILTER yy LIMIT zz
+func pDelete(p *Parser) *QLDelete {
+	stmt := QLDelete{}
+	stmt.Table = pMustSym(p)
+	pScan(p, &stmt.QLScan)
+	return &stmt
+}
+
 func pSelect(p *Parser) *QLSelect {
 	stmt := QLSelect{}
 	pSelectExprList(p, &stmt)
@@ -70,16 +214,39 @@ func pSelectExprList(p *Parser, node *QLSelect) {
 		pSelectExpr(p, node)
 	}
 }
+
+// `*` ,or `expr [AS name]` ,the name defaults to the text of the expression
+func pSelectExpr(p *Parser, node *QLSelect) {
+	if pKeyword(p, "*") {
+		node.Names = append(node.Names, "*")
+		node.Output = append(node.Output, QLNode{Value: Value{Type: QL_STAR}})
+		return
+	}
+	start := p.idx
+	expr := QLNode{}
+	pExprOr(p, &expr)
+	name := ""
+	if p.idx > start {
+		name = string(p.input[p.toks[start].Start:p.toks[p.idx-1].End])
+	}
+	if pKeyword(p, "as") {
+		name = pMustSym(p)
+	}
+	node.Names = append(node.Names, name)
+	node.Output = append(node.Output, expr)
+}
+
 type qlScanIter struct {
 	// input
 	req *QLScan
-	sc Scanner
+	sc  Scanner
 	// state
 	idx int64
 	end bool
 	// cached output item
 	rec Record
-	err
+	err error
+}
 
 func pScan(p *Parser, node *QLScan) {
 	if pKeyword(p, "index", "by") {
@@ -94,6 +261,579 @@ func pScan(p *Parser, node *QLScan) {
 	}
 }
 
+//	CREATE TABLE name (
+//		col type [NULL | NOT NULL] [DEFAULT expr],
+//		PRIMARY KEY (cols) [AUTO_INCREMENT],
+//		INDEX (cols) ,UNIQUE (cols) ,an index column can be a JSON path: doc->'a'->>'b'
+//		[CONSTRAINT name] CHECK (expr),
+//		FOREIGN KEY (cols) REFERENCES table [ON DELETE RESTRICT | CASCADE | SET NULL]
+//	)
+//
+// columns are NOT NULL by default ,the primary key columns are moved to the front
+// the definition is checked by `TableNew()`
+func pCreateTable(p *Parser) *QLCreateTable {
+	stmt := QLCreateTable{}
+	tdef := &stmt.Def
+	tdef.Name = pMustSym(p)
+	pExpect(p, "(", "expect `(`")
+
+	pkey := []string(nil)
+	nullable := []bool(nil)
+	defaults := []QLNode(nil)
+	for p.err == nil {
+		switch {
+		case pKeyword(p, "primary", "key"):
+			if pkey != nil {
+				pErr(p, "duplicate primary key")
+			}
+			pkey = pNameList(p)
+			tdef.AutoInc = pKeyword(p, "auto_increment")
+		case pKeyword(p, "index"):
+			tdef.Indexes = append(tdef.Indexes, pIndexCols(p))
+			tdef.Unique = append(tdef.Unique, false)
+		case pKeyword(p, "unique"):
+			pKeyword(p, "index")
+			tdef.Indexes = append(tdef.Indexes, pIndexCols(p))
+			tdef.Unique = append(tdef.Unique, true)
+		case pKeyword(p, "constraint"):
+			name := pMustSym(p)
+			pExpect(p, "check", "expect `CHECK`")
+			tdef.Checks = append(tdef.Checks, pCheck(p, name))
+		case pKeyword(p, "check"):
+			name := strconv.Itoa(len(tdef.Checks) + 1)
+			tdef.Checks = append(tdef.Checks, pCheck(p, name))
+		case pKeyword(p, "foreign", "key"):
+			tdef.ForeignKeys = append(tdef.ForeignKeys, pForeignKey(p))
+		default:
+			col, typ, null, def := pColumnDef(p)
+			tdef.Cols = append(tdef.Cols, col)
+			tdef.Types = append(tdef.Types, typ)
+			nullable = append(nullable, null)
+			defaults = append(defaults, def)
+		}
+		if !pKeyword(p, ",") {
+			break
+		}
+	}
+	pExpect(p, ")", "expect `)`")
+	if p.err != nil {
+		return &stmt
+	}
+
+	if slices.Contains(nullable, true) {
+		tdef.Nullable = nullable
+	}
+	if slices.ContainsFunc(defaults, func(n QLNode) bool { return n.Type != QL_UNINIT }) {
+		tdef.Defaults = defaults
+	}
+	if !slices.Contains(tdef.Unique, true) {
+		tdef.Unique = nil
+	}
+
+	// the primary key columns first ,in the key order
+	order := []int(nil)
+	for _, col := range pkey {
+		idx := slices.Index(tdef.Cols, col)
+		if idx < 0 || slices.Contains(order, idx) {
+			pErr(p, "primary key: unknown or duplicate column: %s", col)
+			return &stmt
+		}
+		order = append(order, idx)
+	}
+	for i := range tdef.Cols {
+		if !slices.Contains(order, i) {
+			order = append(order, i)
+		}
+	}
+	tdef.Cols = pReorder(tdef.Cols, order)
+	tdef.Types = pReorder(tdef.Types, order)
+	tdef.Nullable = pReorder(tdef.Nullable, order)
+	tdef.Defaults = pReorder(tdef.Defaults, order)
+	tdef.Pkeys = len(pkey)
+	return &stmt
+}
+
+// the items in the new order ,an empty list stays empty
+func pReorder[T any](list []T, order []int) []T {
+	if len(list) == 0 {
+		return list
+	}
+	out := make([]T, 0, len(list))
+	for _, i := range order {
+		out = append(out, list[i])
+	}
+	return out
+}
+
+// `col type [NULL | NOT NULL] [DEFAULT expr]`
+func pColumnDef(p *Parser) (string, uint32, bool, QLNode) {
+	col := pMustSym(p)
+	typ := pType(p)
+	null := false
+	def := QLNode{}
+	for p.err == nil {
+		switch {
+		case pKeyword(p, "not", "null"):
+			null = false
+		case pKeyword(p, "null"):
+			null = true
+		case pKeyword(p, "default"):
+			pExprAdd(p, &def) // `DEFAULT NULL` is the same as no default
+		default:
+			return col, typ, null, def
+		}
+	}
+	return col, typ, null, def
+}
+
+var qlTypeNames = map[string]uint32{
+	"bytes": TYPE_BYTES, "string": TYPE_BYTES,
+	"int64": TYPE_INT64, "int": TYPE_INT64,
+	"float64": TYPE_FLOAT64, "float": TYPE_FLOAT64,
+	"bool":      TYPE_BOOL,
+	"timestamp": TYPE_TIMESTAMP,
+	"decimal":   TYPE_DECIMAL,
+	"json":      TYPE_JSON,
+}
+
+func pType(p *Parser) uint32 {
+	tok := pPeek(p)
+	if p.err != nil {
+		return 0
+	}
+	typ, ok := qlTypeNames[strings.ToLower(tok.Text)]
+	if tok.Type != TOK_SYM || !ok {
+		pErr(p, "expect a column type")
+		return 0
+	}
+	pNext(p)
+	return typ
+}
+
+// `(a, b)`
+func pNameList(p *Parser) []string {
+	pExpect(p, "(", "expect `(`")
+	names := []string{pMustSym(p)}
+	for pKeyword(p, ",") {
+		names = append(names, pMustSym(p))
+	}
+	pExpect(p, ")", "expect `)`")
+	return names
+}
+
+// like `pNameList()` ,a column can be followed by a JSON path ,see jsonColumns.go
+func pIndexCols(p *Parser) []string {
+	pExpect(p, "(", "expect `(`")
+	cols := []string{pIndexCol(p)}
+	for pKeyword(p, ",") {
+		cols = append(cols, pIndexCol(p))
+	}
+	pExpect(p, ")", "expect `)`")
+	return cols
+}
+
+func pIndexCol(p *Parser) string {
+	col := pMustSym(p)
+	for p.err == nil {
+		op := ""
+		switch {
+		case pKeyword(p, "->>"):
+			op = "->>"
+		case pKeyword(p, "->"):
+			op = "->"
+		default:
+			return col
+		}
+		switch tok := pPeek(p); tok.Type {
+		case TOK_STR:
+			col += op + "'" + string(tok.Str) + "'"
+		case TOK_INT:
+			col += op + tok.Text
+		default:
+			pErr(p, "expect a JSON key or index")
+			return col
+		}
+		pNext(p)
+	}
+	return col
+}
+
+// `(expr)` after CHECK
+func pCheck(p *Parser, name string) Check {
+	c := Check{Name: name}
+	pExpect(p, "(", "expect `(`")
+	pExprOr(p, &c.Expr)
+	pExpect(p, ")", "expect `)`")
+	return c
+}
+
+// `(cols) REFERENCES table [ON DELETE action]` after FOREIGN KEY
+func pForeignKey(p *Parser) ForeignKey {
+	fk := ForeignKey{Cols: pNameList(p)}
+	pExpect(p, "references", "expect `REFERENCES`")
+	fk.Table = pMustSym(p)
+	if pKeyword(p, "on", "delete") {
+		switch {
+		case pKeyword(p, "restrict"):
+			fk.OnDelete = FK_RESTRICT
+		case pKeyword(p, "cascade"):
+			fk.OnDelete = FK_CASCADE
+		case pKeyword(p, "set", "null"):
+			fk.OnDelete = FK_SET_NULL
+		default:
+			pErr(p, "expect `RESTRICT` ,`CASCADE` or `SET NULL`")
+		}
+	}
+	return fk
+}
+
+// `INDEX BY a > 1 AND a < 5` ,`INDEX BY (a, b) = (1, 2)`
+// `INDEX BY doc->>'id' = 'x'` on an expression index
+func pIndexBy(p *Parser, node *QLScan) {
+	index := QLNode{}
+	pExprAnd(p, &index)
+	if index.Type == QL_AND {
+		node.Key1, node.Key2 = index.Kids[0], index.Kids[1]
+	} else {
+		node.Key1 = index
+	}
+	pVerifyScanKey(p, &node.Key1)
+	if node.Key2.Type != 0 {
+		pVerifyScanKey(p, &node.Key2)
+	}
+	if node.Key1.Type == QL_CMP_EQ && node.Key2.Type != 0 {
+		pErr(p, "bad `INDEX BY` ,`=` cannot be a range")
+	}
+}
+
+// a comparison of columns (or a tuple of columns) with values
+// a column can be a JSON path ,for an expression index
+func pVerifyScanKey(p *Parser, node *QLNode) {
+	switch node.Type {
+	case QL_CMP_EQ, QL_CMP_GE, QL_CMP_GT, QL_CMP_LT, QL_CMP_LE:
+	default:
+		pErr(p, "bad `INDEX BY` ,expect a comparison")
+		return
+	}
+	cols := []QLNode{node.Kids[0]}
+	if node.Kids[0].Type == QL_TUP {
+		cols = node.Kids[0].Kids
+	}
+	for _, col := range cols {
+		if _, ok := qlIndexColumn(col); !ok {
+			pErr(p, "bad `INDEX BY` ,expect columns on the left")
+			return
+		}
+	}
+}
+
+// the index column of a column or a JSON path ,in the text form of `pIndexCol()`
+// eg `doc -> 'a' ->> 'b'` is `doc->'a'->>'b'`
+func qlIndexColumn(node QLNode) (string, bool) {
+	switch node.Type {
+	case QL_SYM:
+		return string(node.Str), true
+	case QL_JSON_GET, QL_JSON_TEXT:
+		if node.Kids[0].Type == QL_JSON_TEXT {
+			return "", false // `->>` must be the last step
+		}
+		col, ok := qlIndexColumn(node.Kids[0])
+		if !ok {
+			return "", false
+		}
+		op := JSON_PATH_OP
+		if node.Type == QL_JSON_TEXT {
+			op = "->>"
+		}
+		key := node.Kids[1]
+		switch {
+		case key.Type == QL_STR && !bytes.ContainsRune(key.Str, '\''):
+			return col + op + "'" + string(key.Str) + "'", true
+		case key.Type == QL_I64 && key.I64 >= 0:
+			return col + op + strconv.FormatInt(key.I64, 10), true
+		}
+	}
+	return "", false
+}
+
+// `LIMIT count` or `LIMIT offset, count`
+func pLimit(p *Parser, node *QLScan) {
+	offset, count := int64(0), int64(0)
+	ok := pNum(p, &count)
+	if pKeyword(p, ",") {
+		offset = count
+		ok = ok && pNum(p, &count)
+	}
+	if !ok {
+		pErr(p, "bad `LIMIT`")
+		return
+	}
+	node.Offset, node.Limit = offset, count
+}
+
+func pNum(p *Parser, out *int64) bool {
+	if p.err != nil || pPeek(p).Type != TOK_INT {
+		return false
+	}
+	*out = pNext(p).I64
+	return true
+}
+
+// expressions ,from the lowest precedence :
+// OR ,AND ,NOT ,comparisons and IS [NOT] NULL ,+ - ,* / % ,unary - ,-> ->> ,atoms
+
+func pBinop(typ uint32, l QLNode, r QLNode) QLNode {
+	return QLNode{Value: Value{Type: typ}, Kids: []QLNode{l, r}}
+}
+
+func pExprOr(p *Parser, node *QLNode) {
+	pExprAnd(p, node)
+	for pKeyword(p, "or") {
+		r := QLNode{}
+		pExprAnd(p, &r)
+		*node = pBinop(QL_OR, *node, r)
+	}
+}
+
+func pExprAnd(p *Parser, node *QLNode) {
+	pExprNot(p, node)
+	for pKeyword(p, "and") {
+		r := QLNode{}
+		pExprNot(p, &r)
+		*node = pBinop(QL_AND, *node, r)
+	}
+}
+
+func pExprNot(p *Parser, node *QLNode) {
+	if pKeyword(p, "not") {
+		kid := QLNode{}
+		pExprNot(p, &kid)
+		*node = QLNode{Value: Value{Type: QL_NOT}, Kids: []QLNode{kid}}
+		return
+	}
+	pExprCmp(p, node)
+}
+
+var qlCmpOps = []struct {
+	text string
+	typ  uint32
+}{
+	{">=", QL_CMP_GE}, {">", QL_CMP_GT}, {"<", QL_CMP_LT}, {"<=", QL_CMP_LE},
+	{"=", QL_CMP_EQ}, {"!=", QL_CMP_NE}, {"<>", QL_CMP_NE},
+}
+
+func pExprCmp(p *Parser, node *QLNode) {
+	pExprAdd(p, node)
+	if pKeyword(p, "is") {
+		typ := uint32(QL_IS_NULL)
+		if pKeyword(p, "not") {
+			typ = QL_NOT_NULL
+		}
+		pExpect(p, "null", "expect `NULL` after `IS`")
+		*node = QLNode{Value: Value{Type: typ}, Kids: []QLNode{*node}}
+		return
+	}
+	for _, op := range qlCmpOps {
+		if pKeyword(p, op.text) {
+			r := QLNode{}
+			pExprAdd(p, &r)
+			*node = pBinop(op.typ, *node, r)
+			return
+		}
+	}
+}
+
+func pExprAdd(p *Parser, node *QLNode) {
+	pExprMul(p, node)
+	for {
+		typ := uint32(0)
+		switch {
+		case pKeyword(p, "+"):
+			typ = QL_ADD
+		case pKeyword(p, "-"):
+			typ = QL_SUB
+		default:
+			return
+		}
+		r := QLNode{}
+		pExprMul(p, &r)
+		*node = pBinop(typ, *node, r)
+	}
+}
+
+func pExprMul(p *Parser, node *QLNode) {
+	pExprUnop(p, node)
+	for {
+		typ := uint32(0)
+		switch {
+		case pKeyword(p, "*"):
+			typ = QL_MUL
+		case pKeyword(p, "/"):
+			typ = QL_DIV
+		case pKeyword(p, "%"):
+			typ = QL_MOD
+		default:
+			return
+		}
+		r := QLNode{}
+		pExprUnop(p, &r)
+		*node = pBinop(typ, *node, r)
+	}
+}
+
+func pExprUnop(p *Parser, node *QLNode) {
+	if pKeyword(p, "-") {
+		kid := QLNode{}
+		pExprUnop(p, &kid)
+		*node = QLNode{Value: Value{Type: QL_NEG}, Kids: []QLNode{kid}}
+		return
+	}
+	pExprJSON(p, node)
+}
+
+// `doc->'a'->>'b'`
+func pExprJSON(p *Parser, node *QLNode) {
+	pExprAtom(p, node)
+	for {
+		typ := uint32(0)
+		switch {
+		case pKeyword(p, "->>"):
+			typ = QL_JSON_TEXT
+		case pKeyword(p, "->"):
+			typ = QL_JSON_GET
+		default:
+			return
+		}
+		r := QLNode{}
+		pExprAtom(p, &r)
+		*node = pBinop(typ, *node, r)
+	}
+}
+
+// a literal ,a column ,`(expr)` or a tuple `(a, b)`
+func pExprAtom(p *Parser, node *QLNode) {
+	if p.err != nil {
+		return
+	}
+	if pKeyword(p, "(") {
+		pExprOr(p, node)
+		if pKeyword(p, ",") {
+			tup := QLNode{Value: Value{Type: QL_TUP}, Kids: []QLNode{*node}}
+			for {
+				kid := QLNode{}
+				pExprOr(p, &kid)
+				tup.Kids = append(tup.Kids, kid)
+				if !pKeyword(p, ",") {
+					break
+				}
+			}
+			*node = tup
+		}
+		pExpect(p, ")", "expect `)`")
+		return
+	}
+
+	switch {
+	case pKeyword(p, "null"):
+		*node = QLNode{Value: Value{Type: QL_NULL}}
+		return
+	case pKeyword(p, "true"):
+		*node = QLNode{Value: Value{Type: QL_BOOL, I64: 1}}
+		return
+	case pKeyword(p, "false"):
+		*node = QLNode{Value: Value{Type: QL_BOOL, I64: 0}}
+		return
+	}
+
+	// typed literals ,`TIMESTAMP '2024-01-02 03:04:05'` ,`DECIMAL '12.34'`
+	if p.idx+1 < len(p.toks) && p.toks[p.idx+1].Type == TOK_STR {
+		switch {
+		case pKeyword(p, "timestamp"):
+			pTypedLiteral(p, QL_TIMESTAMP, node)
+			return
+		case pKeyword(p, "decimal"):
+			pTypedLiteral(p, QL_DECIMAL, node)
+			return
+		}
+	}
+
+	tok := pPeek(p)
+	switch tok.Type {
+	case TOK_INT:
+		*node = QLNode{Value: Value{Type: QL_I64, I64: tok.I64}}
+	case TOK_FLOAT:
+		*node = QLNode{Value: Value{Type: QL_F64, F64: tok.F64}}
+	case TOK_STR:
+		*node = QLNode{Value: Value{Type: QL_STR, Str: tok.Str}}
+	case TOK_SYM:
+		if isReserved(tok.Text) {
+			pErr(p, "unexpected keyword %q", tok.Text)
+			return
+		}
+		*node = QLNode{Value: Value{Type: QL_SYM, Str: []byte(tok.Text)}}
+	case TOK_EOF:
+		pErr(p, "expect an expression ,got the end of input")
+		return
+	default:
+		pErr(p, "expect an expression ,got %q", tok.Text)
+		return
+	}
+	pNext(p)
+}
+
+// the formats of a TIMESTAMP literal ,UTC unless it has a zone
+var qlTimeFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// the string after TIMESTAMP or DECIMAL
+func pTypedLiteral(p *Parser, typ uint32, node *QLNode) {
+	tok := pPeek(p)
+	switch typ {
+	case QL_TIMESTAMP:
+		for _, layout := range qlTimeFormats {
+			if t, err := time.Parse(layout, string(tok.Str)); err == nil {
+				*node = QLNode{Value: Value{Type: QL_TIMESTAMP, I64: t.UnixMicro()}}
+				pNext(p)
+				return
+			}
+		}
+		pErr(p, "bad timestamp: %q", tok.Str)
+	case QL_DECIMAL:
+		d, err := ParseDecimal(string(tok.Str))
+		if err != nil {
+			pErr(p, "%v", err)
+			return
+		}
+		*node = QLNode{Value: Value{Type: QL_DECIMAL, I64: d}}
+		pNext(p)
+	default:
+		panic("unreachable")
+	}
+}
+
+// the name of a type in errors
+func qlTypeName(typ uint32) string {
+	switch typ {
+	case TYPE_NULL:
+		return "NULL"
+	case TYPE_BYTES:
+		return "BYTES"
+	case TYPE_INT64:
+		return "INT64"
+	case TYPE_FLOAT64:
+		return "FLOAT64"
+	case TYPE_BOOL:
+		return "BOOL"
+	case TYPE_TIMESTAMP:
+		return "TIMESTAMP"
+	case TYPE_DECIMAL:
+		return "DECIMAL"
+	case TYPE_JSON:
+		return "JSON"
+	default:
+		return fmt.Sprintf("type %d", typ)
+	}
+}
+
 // evalutes an expression tree rooted at node
 func qlEval(ctx *QLEvalContex, node QLNode) {
 	switch node.Type {
@@ -106,24 +846,323 @@ func qlEval(ctx *QLEvalContex, node QLNode) {
 			//  if not found ,it sets an error
 			qlErr(ctx, "unknown column :%s", node.Str)
 		}
-	// QL_I64, QL_STR: Literal values
-	case QL_I64, QL_STR:
+	// QL_I64, QL_STR ...: Literal values
+	case QL_I64, QL_STR, QL_F64, QL_BOOL, QL_TIMESTAMP, QL_DECIMAL:
 		// sets the output to the literal value
 		ctx.out = node.Value
+	case QL_NULL:
+		ctx.out = Value{Type: TYPE_NULL}
 
 	//  QL_NEG: Unary negation
 	case QL_NEG:
 		// it recursively evalutes the child node
 		qlEval(ctx, node.Kids[0])
-		//  if the result is an integer ,it negates it
-		if ctx.out.Type == TYPE_INT64 {
+		//  if the result is a number ,it negates it
+		switch ctx.out.Type {
+		case TYPE_INT64, TYPE_DECIMAL:
 			// this handle unary minus
 			ctx.out.I64 = -ctx.out.I64
-		} else {
+		case TYPE_FLOAT64:
+			ctx.out.F64 = -ctx.out.F64
+		case TYPE_NULL: // -NULL is NULL
+		default:
 			qlErr(ctx, "QL_NEG type error")
 		}
+
+	// NOT NULL is NULL
+	case QL_NOT:
+		qlEval(ctx, node.Kids[0])
+		if ctx.out.Type == TYPE_BOOL {
+			ctx.out.I64 = 1 - ctx.out.I64
+		} else if ctx.out.Type != TYPE_NULL {
+			qlErr(ctx, "QL_NOT type error")
+		}
+
+	// the only tests that never return NULL
+	case QL_IS_NULL, QL_NOT_NULL:
+		qlEval(ctx, node.Kids[0])
+		isNull := ctx.out.Type == TYPE_NULL
+		ctx.out = qlBoolValue(isNull == (node.Type == QL_IS_NULL))
+
+	// three-valued logic ,NULL means unknown :
+	// FALSE AND NULL = FALSE ,TRUE OR NULL = TRUE ,otherwise NULL wins
+	case QL_AND, QL_OR:
+		l, r := qlEvalKids(ctx, node)
+		if ctx.err != nil {
+			return
+		}
+		if (l.Type != TYPE_BOOL && l.Type != TYPE_NULL) || (r.Type != TYPE_BOOL && r.Type != TYPE_NULL) {
+			qlErr(ctx, "logical op type error")
+			return
+		}
+		// the value that decides the result on its own
+		short := int64(0) // FALSE for AND
+		if node.Type == QL_OR {
+			short = 1 // TRUE for OR
+		}
+		switch {
+		case l.Type == TYPE_BOOL && l.I64 == short, r.Type == TYPE_BOOL && r.I64 == short:
+			ctx.out = Value{Type: TYPE_BOOL, I64: short}
+		case l.Type == TYPE_NULL || r.Type == TYPE_NULL:
+			ctx.out = Value{Type: TYPE_NULL}
+		default:
+			ctx.out = Value{Type: TYPE_BOOL, I64: 1 - short}
+		}
+
+	// a missing key or index gives NULL ,see `jsonPath()`
+	case QL_JSON_GET, QL_JSON_TEXT:
+		l, r := qlEvalKids(ctx, node)
+		if ctx.err != nil {
+			return
+		}
+		if l.Type == TYPE_NULL || r.Type == TYPE_NULL {
+			ctx.out = Value{Type: TYPE_NULL}
+			return
+		}
+		if l.Type != TYPE_JSON {
+			qlErr(ctx, "JSON path on a non JSON value")
+			return
+		}
+		out, err := jsonPath(l, []Value{r}, node.Type == QL_JSON_TEXT)
+		if err != nil {
+			qlErr(ctx, "%v", err)
+			return
+		}
+		ctx.out = out
+
+	// any NULL operand gives NULL
+	case QL_CMP_GE, QL_CMP_GT, QL_CMP_LT, QL_CMP_LE, QL_CMP_EQ, QL_CMP_NE,
+		QL_ADD, QL_SUB, QL_MUL, QL_DIV, QL_MOD:
+		l, r := qlEvalKids(ctx, node)
+		if ctx.err != nil {
+			return
+		}
+		if l.Type == TYPE_NULL || r.Type == TYPE_NULL {
+			ctx.out = Value{Type: TYPE_NULL}
+			return
+		}
+		qlBinop(ctx, node.Type, l, r)
+
+	default:
+		qlErr(ctx, "unknown expression type: %d", node.Type)
+	}
+
+}
+
+// evaluate the 2 operands of a binary op
+func qlEvalKids(ctx *QLEvalContex, node QLNode) (Value, Value) {
+	qlEval(ctx, node.Kids[0])
+	l := ctx.out
+	qlEval(ctx, node.Kids[1])
+	r := ctx.out
+	return l, r
+}
+
+// mixed numbers are converted to the wider type :
+// INT64 and FLOAT64 -> FLOAT64 ,INT64 and DECIMAL -> DECIMAL ,DECIMAL and FLOAT64 -> FLOAT64
+func qlPromote(l Value, r Value) (Value, Value, bool) {
+	wider := func(a, b uint32) bool {
+		return (a == TYPE_INT64 && (b == TYPE_FLOAT64 || b == TYPE_DECIMAL)) ||
+			(a == TYPE_DECIMAL && b == TYPE_FLOAT64)
+	}
+	ok := true
+	switch {
+	case l.Type == r.Type:
+	case wider(l.Type, r.Type):
+		l, ok = convertValue(l, r.Type)
+	case wider(r.Type, l.Type):
+		r, ok = convertValue(r, l.Type)
+	default:
+		ok = false
+	}
+	return l, r, ok
+}
+
+// both operands are not NULL
+func qlBinop(ctx *QLEvalContex, op uint32, l Value, r Value) {
+	// time arithmetic ,the INT64 is in microseconds
+	if l.Type == TYPE_TIMESTAMP || r.Type == TYPE_TIMESTAMP {
+		switch {
+		case op == QL_SUB && l.Type == TYPE_TIMESTAMP && r.Type == TYPE_TIMESTAMP:
+			ctx.out = Value{Type: TYPE_INT64, I64: l.I64 - r.I64}
+			return
+		case op == QL_ADD && l.Type == TYPE_TIMESTAMP && r.Type == TYPE_INT64:
+			ctx.out = Value{Type: TYPE_TIMESTAMP, I64: l.I64 + r.I64}
+			return
+		case op == QL_ADD && l.Type == TYPE_INT64 && r.Type == TYPE_TIMESTAMP:
+			ctx.out = Value{Type: TYPE_TIMESTAMP, I64: l.I64 + r.I64}
+			return
+		case op == QL_SUB && l.Type == TYPE_TIMESTAMP && r.Type == TYPE_INT64:
+			ctx.out = Value{Type: TYPE_TIMESTAMP, I64: l.I64 - r.I64}
+			return
+		}
+	}
+
+	l, r, ok := qlPromote(l, r)
+	if !ok {
+		qlErr(ctx, "binary op type mismatch")
+		return
+	}
+	switch op {
+	case QL_CMP_GE, QL_CMP_GT, QL_CMP_LT, QL_CMP_LE, QL_CMP_EQ, QL_CMP_NE:
+		c := qlCompare(l, r)
+		res := false
+		switch op {
+		case QL_CMP_GE:
+			res = c >= 0
+		case QL_CMP_GT:
+			res = c > 0
+		case QL_CMP_LT:
+			res = c < 0
+		case QL_CMP_LE:
+			res = c <= 0
+		case QL_CMP_EQ:
+			res = c == 0
+		case QL_CMP_NE:
+			res = c != 0
+		}
+		ctx.out = qlBoolValue(res)
+		return
+	}
+
+	switch l.Type {
+	case TYPE_BYTES:
+		if op != QL_ADD {
+			qlErr(ctx, "arithmetic on strings")
+			return
+		}
+		// string concatenation
+		ctx.out = Value{Type: TYPE_BYTES, Str: append(append([]byte(nil), l.Str...), r.Str...)}
+	case TYPE_INT64:
+		qlArithI64(ctx, op, l.I64, r.I64)
+	case TYPE_FLOAT64:
+		qlArithF64(ctx, op, l.F64, r.F64)
+	case TYPE_DECIMAL:
+		qlArithDecimal(ctx, op, l.I64, r.I64)
+	default:
+		qlErr(ctx, "arithmetic type error")
+	}
+}
+
+func qlArithI64(ctx *QLEvalContex, op uint32, l int64, r int64) {
+	out := Value{Type: TYPE_INT64}
+	switch op {
+	case QL_ADD:
+		out.I64 = l + r
+	case QL_SUB:
+		out.I64 = l - r
+	case QL_MUL:
+		out.I64 = l * r
+	case QL_DIV, QL_MOD:
+		if r == 0 {
+			qlErr(ctx, "division by zero")
+			return
+		}
+		if op == QL_DIV {
+			out.I64 = l / r
+		} else {
+			out.I64 = l % r
+		}
+	}
+	ctx.out = out
+}
+
+func qlArithF64(ctx *QLEvalContex, op uint32, l float64, r float64) {
+	out := Value{Type: TYPE_FLOAT64}
+	switch op {
+	case QL_ADD:
+		out.F64 = l + r
+	case QL_SUB:
+		out.F64 = l - r
+	case QL_MUL:
+		out.F64 = l * r
+	case QL_DIV:
+		if r == 0 {
+			qlErr(ctx, "division by zero")
+			return
+		}
+		out.F64 = l / r
+	case QL_MOD:
+		qlErr(ctx, "modulo on floats")
+		return
+	}
+	ctx.out = out
+}
+
+// both are scaled by DECIMAL_ONE ,products and quotients are rescaled with big ints
+// to not overflow in between
+func qlArithDecimal(ctx *QLEvalContex, op uint32, l int64, r int64) {
+	out := Value{Type: TYPE_DECIMAL}
+	switch op {
+	case QL_ADD:
+		out.I64 = l + r
+	case QL_SUB:
+		out.I64 = l - r
+	case QL_MUL, QL_DIV:
+		res := new(big.Int)
+		if op == QL_MUL {
+			res.Mul(big.NewInt(l), big.NewInt(r))
+			res.Quo(res, big.NewInt(DECIMAL_ONE))
+		} else {
+			if r == 0 {
+				qlErr(ctx, "division by zero")
+				return
+			}
+			res.Mul(big.NewInt(l), big.NewInt(DECIMAL_ONE))
+			res.Quo(res, big.NewInt(r))
+		}
+		if !res.IsInt64() {
+			qlErr(ctx, "decimal overflow")
+			return
+		}
+		out.I64 = res.Int64()
+	case QL_MOD:
+		if r == 0 {
+			qlErr(ctx, "division by zero")
+			return
+		}
+		out.I64 = l % r
+	}
+	ctx.out = out
+}
+
+// compare 2 non NULL values of the same type
+func qlCompare(l Value, r Value) int {
+	switch l.Type {
+	case TYPE_INT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_DECIMAL:
+		return cmp.Compare(l.I64, r.I64)
+	case TYPE_FLOAT64:
+		return cmp.Compare(l.F64, r.F64)
+	case TYPE_BYTES, TYPE_JSON:
+		return bytes.Compare(l.Str, r.Str)
+	default:
+		panic("unreachable")
 	}
+}
 
+// booleans are 0 or 1
+func qlBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func qlBoolValue(b bool) Value {
+	return Value{Type: TYPE_BOOL, I64: qlBool(b)}
+}
+
+// a row passes a `FILTER` only if it is TRUE ,FALSE and NULL both drop it
+func qlIsTrue(v Value) bool {
+	return v.Type == TYPE_BOOL && v.I64 != 0
+}
+
+// record the 1st error
+func qlErr(ctx *QLEvalContex, format string, args ...interface{}) {
+	if ctx.err == nil {
+		ctx.out = Value{Type: QL_ERR}
+		ctx.err = fmt.Errorf(format, args...)
+	}
 }
 
 func qlScanInit(req *QLScan, sc *Scanner) (err error) {
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var qlOpNames = map[uint32]string{
+	QL_CMP_GE: ">=", QL_CMP_GT: ">", QL_CMP_LT: "<", QL_CMP_LE: "<=", QL_CMP_EQ: "=", QL_CMP_NE: "!=",
+	QL_ADD: "+", QL_SUB: "-", QL_MUL: "*", QL_DIV: "/", QL_MOD: "%",
+	QL_AND: "and", QL_OR: "or", QL_NOT: "not", QL_NEG: "neg",
+	QL_IS_NULL: "is-null", QL_NOT_NULL: "not-null",
+	QL_JSON_GET: "->", QL_JSON_TEXT: "->>", QL_TUP: "tup",
+}
+
+// an expression in prefix form ,eg `(+ a 1)`
+func qlFormat(node QLNode) string {
+	switch node.Type {
+	case QL_SYM:
+		return string(node.Str)
+	case QL_I64:
+		return strconv.FormatInt(node.I64, 10)
+	case QL_F64:
+		return strconv.FormatFloat(node.F64, 'g', -1, 64)
+	case QL_STR:
+		return "'" + string(node.Str) + "'"
+	case QL_BOOL:
+		return strconv.FormatBool(node.I64 != 0)
+	case QL_NULL:
+		return "null"
+	}
+	parts := []string{qlOpNames[node.Type]}
+	for _, kid := range node.Kids {
+		parts = append(parts, qlFormat(kid))
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+func parseExpr(in string) (QLNode, error) {
+	p := NewParser(in)
+	node := QLNode{}
+	pExprOr(p, &node)
+	if !pEnd(p) && p.err == nil {
+		pErr(p, "unexpected %q", pPeek(p).Text)
+	}
+	return node, p.err
+}
+
+func TestParseExprPrecedence(t *testing.T) {
+	cases := map[string]string{
+		"a or b and c":                    "(or a (and b c))",
+		"a and b or c":                    "(or (and a b) c)",
+		"not a = 1 and b":                 "(and (not (= a 1)) b)",
+		"not a is null":                   "(not (is-null a))",
+		"a + 1 >= b * 2":                  "(>= (+ a 1) (* b 2))",
+		"1 + 2 * 3 - 4":                   "(- (+ 1 (* 2 3)) 4)",
+		"a - b - c":                       "(- (- a b) c)",
+		"a / b % c":                       "(% (/ a b) c)",
+		"-a * b":                          "(* (neg a) b)",
+		"(a + b) * c":                     "(* (+ a b) c)",
+		"a is not null or b != 1":         "(or (not-null a) (!= b 1))",
+		"doc->'a'->>'b' = 'x'":            "(= (->> (-> doc 'a') 'b') 'x')",
+		"doc->0 is null":                  "(is-null (-> doc 0))",
+		"(a, b) >= (1, 2.5)":              "(>= (tup a b) (tup 1 2.5))",
+		"true and null":                   "(and true null)",
+		"-doc->'n' + 1":                   "(+ (neg (-> doc 'n')) 1)",
+		"a = 1 and b = 2 and c = 3":       "(and (and (= a 1) (= b 2)) (= c 3))",
+		"a < 1 or not (b > 2 and c <= 3)": "(or (< a 1) (not (and (> b 2) (<= c 3))))",
+	}
+	for in, want := range cases {
+		node, err := parseExpr(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+		} else if got := qlFormat(node); got != want {
+			t.Errorf("%s: got %s ,expected %s", in, got, want)
+		}
+	}
+	for _, in := range []string{"a +", "a and", "(a", "a = = 1", "select"} {
+		if _, err := parseExpr(in); err == nil {
+			t.Errorf("%s: no error", in)
+		}
+	}
+}
+
+func TestParseCreateTable(t *testing.T) {
+	stmt, err := ParseStmt(`create table t (
+		a int null default 1,
+		b string,
+		c float not null,
+		d int default -2,
+		primary key (c, b),
+		unique (a),
+		index (d),
+		constraint pos check (a > 0),
+		check (d < c),
+		foreign key (b) references p on delete cascade
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdef := stmt.(*QLCreateTable).Def
+	// the primary key columns first
+	if want := []string{"c", "b", "a", "d"}; !reflect.DeepEqual(tdef.Cols, want) {
+		t.Errorf("cols %v", tdef.Cols)
+	}
+	if want := []uint32{TYPE_FLOAT64, TYPE_BYTES, TYPE_INT64, TYPE_INT64}; !reflect.DeepEqual(tdef.Types, want) {
+		t.Errorf("types %v", tdef.Types)
+	}
+	if want := []bool{false, false, true, false}; !reflect.DeepEqual(tdef.Nullable, want) {
+		t.Errorf("nullable %v", tdef.Nullable)
+	}
+	defaults := []string(nil)
+	for _, def := range tdef.Defaults {
+		defaults = append(defaults, qlFormat(def))
+	}
+	if want := []string{"()", "()", "1", "(neg 2)"}; !reflect.DeepEqual(defaults, want) {
+		t.Errorf("defaults %v", defaults)
+	}
+	if tdef.Pkeys != 2 || tdef.AutoInc {
+		t.Errorf("pkeys %d ,auto-increment %v", tdef.Pkeys, tdef.AutoInc)
+	}
+	if want := [][]string{{"a"}, {"d"}}; !reflect.DeepEqual(tdef.Indexes, want) {
+		t.Errorf("indexes %v", tdef.Indexes)
+	}
+	if want := []bool{true, false}; !reflect.DeepEqual(tdef.Unique, want) {
+		t.Errorf("unique %v", tdef.Unique)
+	}
+	checks := []string(nil)
+	for _, c := range tdef.Checks {
+		checks = append(checks, c.Name+" "+qlFormat(c.Expr))
+	}
+	if want := []string{"pos (> a 0)", "2 (< d c)"}; !reflect.DeepEqual(checks, want) {
+		t.Errorf("checks %v", checks)
+	}
+	want := []ForeignKey{{Cols: []string{"b"}, Table: "p", OnDelete: FK_CASCADE}}
+	if !reflect.DeepEqual(tdef.ForeignKeys, want) {
+		t.Errorf("foreign keys %+v", tdef.ForeignKeys)
+	}
+
+	// no NULL ,default or unique index
+	stmt, err = ParseStmt(`create table u (id int, primary key (id) auto_increment)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdef = stmt.(*QLCreateTable).Def
+	if tdef.Nullable != nil || tdef.Defaults != nil || tdef.Unique != nil || !tdef.AutoInc {
+		t.Errorf("got %+v", tdef)
+	}
+}
+
+func TestParseCreateTableErrors(t *testing.T) {
+	cases := map[string]string{
+		`create table t (a int, primary key (b))`:                          "unknown or duplicate column: b",
+		`create table t (a int, primary key (a, a))`:                       "unknown or duplicate column: a",
+		`create table t (a int, primary key (a), primary key (a))`:         "duplicate primary key",
+		`create table t (a blob)`:                                          "expect a column type",
+		`create table t (a int, foreign key (a) references p on delete x)`: "expect `RESTRICT`",
+		`create table t (a int, constraint c (a > 0))`:                     "expect `CHECK`",
+		// keywords are not names
+		`create table t (key int, primary key (key))`:    "expect name",
+		`create table t (unique int)`:                    "expect `(`",
+		`create table t (a int default 1 check (a > 0))`: "expect `)`",
+		`create table select (a int)`:                    "expect name",
+	}
+	for in, want := range cases {
+		if _, err := ParseStmt(in); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v ,expected %q", in, err, want)
+		}
+	}
+}
+
+func parseScan(t *testing.T, in string) (*QLSelect, error) {
+	t.Helper()
+	stmt, err := ParseStmt(in)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.(*QLSelect), nil
+}
+
+func TestParseIndexBy(t *testing.T) {
+	cases := []struct {
+		in, key1, key2 string
+	}{
+		{"a = 1", "(= a 1)", "()"},
+		{"a > 1 and a <= 5", "(> a 1)", "(<= a 5)"},
+		{"(a, b) >= (1, 'x')", "(>= (tup a b) (tup 1 'x'))", "()"},
+		{"doc->'a'->>'id' = 'x'", "(= (->> (-> doc 'a') 'id') 'x')", "()"},
+	}
+	for _, c := range cases {
+		stmt, err := parseScan(t, "select * from t index by "+c.in)
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+			continue
+		}
+		if k1, k2 := qlFormat(stmt.Key1), qlFormat(stmt.Key2); k1 != c.key1 || k2 != c.key2 {
+			t.Errorf("%s: got %s %s", c.in, k1, k2)
+		}
+	}
+
+	errs := map[string]string{
+		"a = 1 and a < 2":    "`=` cannot be a range",
+		"a":                  "expect a comparison",
+		"a != 1":             "expect a comparison",
+		"1 = a":              "expect columns on the left",
+		"a + 1 > 2":          "expect columns on the left",
+		"doc->>'a'->'b' = 1": "expect columns on the left",
+		"a > 1 or a < 0":     "unexpected",
+	}
+	for in, want := range errs {
+		if _, err := parseScan(t, "select * from t index by "+in); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v ,expected %q", in, err, want)
+		}
+	}
+}
+
+// the text of an index column ,like in CREATE TABLE
+func TestQLIndexColumn(t *testing.T) {
+	cases := map[string]string{
+		"a":                 "a",
+		"doc->'a'":          "doc->'a'",
+		"doc->'a'->1->>'b'": "doc->'a'->1->>'b'",
+		"doc -> 'x y'":      "doc->'x y'",
+		// not an index column
+		"doc->>'a'->'b'": "",
+		`doc->"it's"`:    "",
+		"doc->a":         "",
+		"a + 1":          "",
+	}
+	for in, want := range cases {
+		node, err := parseExpr(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		got, ok := qlIndexColumn(node)
+		if got != want || ok != (want != "") {
+			t.Errorf("%s: got %q %v", in, got, ok)
+		}
+		if !ok {
+			continue
+		}
+		// the same text as in CREATE TABLE
+		stmt, err := ParseStmt("create table t (id int, doc json, index (" + in + "), primary key (id))")
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+		} else if idx := stmt.(*QLCreateTable).Def.Indexes[0][0]; idx != want {
+			t.Errorf("%s: CREATE TABLE gives %q", in, idx)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	cases := []struct {
+		in            string
+		offset, limit int64
+	}{
+		{"", 0, math.MaxInt64},
+		{"limit 10", 0, 10},
+		{"limit 5, 10", 5, 10},
+		{"limit 0", 0, 0},
+		{"filter a > 1 limit 3", 0, 3},
+	}
+	for _, c := range cases {
+		stmt, err := parseScan(t, "select a from t "+c.in)
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+		} else if stmt.Offset != c.offset || stmt.Limit != c.limit {
+			t.Errorf("%s: got %d ,%d", c.in, stmt.Offset, stmt.Limit)
+		}
+	}
+	for _, in := range []string{"limit", "limit x", "limit 1,", "limit -1", "limit 1.5", "limit 1 filter a"} {
+		if _, err := parseScan(t, "select a from t "+in); err == nil {
+			t.Errorf("%s: no error", in)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// Table definition cache : parsed `TableDef`s ,so a lookup doesnt read and
+// decode `@table` every time.
+//
+// The cache must agree with the snapshot of each tx :
+//   - a tx that changed a definition (DDL) reads it from its own pending writes,
+//     the names are kept in `DBTX.ddl` (see `tableDefChanged()`)
+//   - `DB.Commit()` of such a tx removes the names from the cache before the KV commit ,
+//     and they cant be cached again until it is done (`committing`) ,so no reader sees
+//     the old definition at the new version. After the commit it remembers the version of the change.
+//     The cache lock is not held during the KV commit ,it would block every lookup on the fsync
+//   - an entry is valid from the version of the last change ,an older tx doesnt use it
+//     (`KVTX.version` is the version the tx began at ,see `KV.Begin()`)
+//
+// The cached `TableDef`s are shared between txs ,they must not be modified.
+// DDL works on a copy (see `cloneTableDef()`).
+
+type tableCache struct {
+	mutex   sync.RWMutex
+	defs    map[string]tableCacheEntry
+	changed map[string]uint64 // the version of the last DDL on a table ,since the db was opened
+	// the tables changed by txs being committed ,not cached until the commit is done
+	committing map[string]int
+}
+
+type tableCacheEntry struct {
+	tdef  *TableDef
+	since uint64 // valid for txs at this version or later
+}
+
+// the cached definition ,if it can be used at the version of the tx
+func tableCacheGet(tx *DBTX, name string) *TableDef {
+	cache := &tx.db.cache
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	entry, ok := cache.defs[name]
+	if !ok || versionBefore(tx.kv.version, entry.since) {
+		return nil
+	}
+	return entry.tdef
+}
+
+// add a definition read by the tx ,unless a later DDL made it outdated
+func tableCachePut(tx *DBTX, name string, tdef *TableDef) {
+	cache := &tx.db.cache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	since := cache.changed[name]
+	if versionBefore(tx.kv.version, since) || cache.committing[name] > 0 {
+		return // the tx is older than the last change ,or a change is being committed
+	}
+	if cache.defs == nil {
+		cache.defs = map[string]tableCacheEntry{}
+	}
+	cache.defs[name] = tableCacheEntry{tdef: tdef, since: since}
+}
+
+// called for every write to `@table`
+func tableDefChanged(tx *DBTX, name string) {
+	if !slices.Contains(tx.ddl, name) {
+		tx.ddl = append(tx.ddl, name)
+	}
+}
+
+// commit a tx that changed definitions
+func tableCacheCommit(db *DB, tx *DBTX) error {
+	cache := &db.cache
+	cache.mutex.Lock()
+	if cache.committing == nil {
+		cache.committing = map[string]int{}
+	}
+	for _, name := range tx.ddl {
+		delete(cache.defs, name)
+		cache.committing[name]++
+	}
+	cache.mutex.Unlock()
+
+	err := db.kv.Commit(&tx.kv)
+
+	db.kv.mutex.Lock()
+	version := db.kv.version // later than the tx if other txs committed ,that is fine
+	db.kv.mutex.Unlock()
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.changed == nil {
+		cache.changed = map[string]uint64{}
+	}
+	for _, name := range tx.ddl {
+		if cache.committing[name]--; cache.committing[name] == 0 {
+			delete(cache.committing, name)
+		}
+		if err == nil {
+			cache.changed[name] = version
+		}
+	}
+	return err
+}
+
+// a deep copy to modify
+func cloneTableDef(tdef *TableDef) *TableDef {
+	out := *tdef
+	out.Types = slices.Clone(tdef.Types)
+	out.Cols = slices.Clone(tdef.Cols)
+	out.Nullable = slices.Clone(tdef.Nullable)
+	out.Prefixes = slices.Clone(tdef.Prefixes)
+	out.Unique = slices.Clone(tdef.Unique)
+	out.RefBy = slices.Clone(tdef.RefBy)
+	out.Defaults = slices.Clone(tdef.Defaults)
+	out.Checks = slices.Clone(tdef.Checks)
+	for i := range out.Checks {
+		out.Checks[i].Expr = qlClone(tdef.Checks[i].Expr) // renamed in place
+	}
+	out.ForeignKeys = slices.Clone(tdef.ForeignKeys)
+	for i := range out.ForeignKeys {
+		out.ForeignKeys[i].Cols = slices.Clone(tdef.ForeignKeys[i].Cols)
+	}
+	out.Indexes = make([][]string, len(tdef.Indexes))
+	for i, index := range tdef.Indexes {
+		out.Indexes[i] = slices.Clone(index)
+	}
+	return &out
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db := &DB{}
+	db.kv.Path = filepath.Join(t.TempDir(), "test.db")
+	if err := db.kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.kv.Close() })
+	return db
+}
+
+func readTableDef(t *testing.T, tx *DBTX, name string) *TableDef {
+	t.Helper()
+	tdef, err := getTableDef(tx, name)
+	if err != nil || tdef == nil {
+		t.Fatalf("table %s: %v", name, err)
+	}
+	return tdef
+}
+
+func cachedTableDef(db *DB, name string) *TableDef {
+	db.cache.mutex.RLock()
+	defer db.cache.mutex.RUnlock()
+	return db.cache.defs[name].tdef
+}
+
+func TestTableCacheInvalidate(t *testing.T) {
+	db := openTestDB(t)
+	err := db.TableNew(&TableDef{
+		Name:    "t",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"a", "b"},
+		Pkeys:   1,
+		Indexes: [][]string{{"a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a tx from before the DDL
+	old := DBTX{}
+	db.Begin(&old)
+	defer db.Abort(&old)
+
+	if err := db.TableAddColumn("t", "c", TYPE_INT64, Value{}); err != nil {
+		t.Fatal(err)
+	}
+	if cachedTableDef(db, "t") != nil {
+		t.Fatal("the definition is still cached after the DDL")
+	}
+
+	// the old tx sees its snapshot ,and doesnt put it in the cache
+	if tdef := readTableDef(t, &old, "t"); slices.Contains(tdef.Cols, "c") {
+		t.Fatal("the old tx sees the new column")
+	}
+	if cachedTableDef(db, "t") != nil {
+		t.Fatal("the old tx cached an outdated definition")
+	}
+
+	// a new tx sees the change ,and caches it again
+	tx := DBTX{}
+	db.Begin(&tx)
+	defer db.Abort(&tx)
+	tdef := readTableDef(t, &tx, "t")
+	if !slices.Contains(tdef.Cols, "c") {
+		t.Fatal("the new tx doesnt see the new column")
+	}
+	if cachedTableDef(db, "t") != tdef {
+		t.Fatal("the definition is not cached after the DDL")
+	}
+	if readTableDef(t, &tx, "t") != tdef {
+		t.Fatal("the cached definition is not used")
+	}
+}
+
+func TestTableCacheOwnDDL(t *testing.T) {
+	db := openTestDB(t)
+	tx := DBTX{}
+	db.Begin(&tx)
+	defer db.Abort(&tx)
+	err := tx.TableNew(&TableDef{
+		Name:    "t",
+		Types:   []uint32{TYPE_INT64},
+		Cols:    []string{"a"},
+		Pkeys:   1,
+		Indexes: [][]string{{"a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not committed ,only this tx can see it
+	readTableDef(t, &tx, "t")
+	if cachedTableDef(db, "t") != nil {
+		t.Fatal("an uncommitted definition is cached")
+	}
+}
+
+// a definition read while a DDL on it is being committed is not cached ,
+// the reader may see either version (see `tableCacheCommit()`)
+func TestTableCacheCommitting(t *testing.T) {
+	db := openTestDB(t)
+	err := db.TableNew(&TableDef{
+		Name:    "t",
+		Types:   []uint32{TYPE_INT64},
+		Cols:    []string{"a"},
+		Pkeys:   1,
+		Indexes: [][]string{{"a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.cache.mutex.Lock()
+	db.cache.committing["t"]++
+	db.cache.mutex.Unlock()
+
+	tx := DBTX{}
+	db.Begin(&tx)
+	readTableDef(t, &tx, "t")
+	db.Abort(&tx)
+	if cachedTableDef(db, "t") != nil {
+		t.Fatal("cached during a commit")
+	}
+
+	db.cache.mutex.Lock()
+	db.cache.committing["t"]--
+	db.cache.mutex.Unlock()
+	db.Begin(&tx)
+	defer db.Abort(&tx)
+	if tdef := readTableDef(t, &tx, "t"); cachedTableDef(db, "t") != tdef {
+		t.Fatal("not cached after the commit")
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Instead of storing multiple tables in multiple btree
@@ -12,10 +20,28 @@ import (
 // and this key maps to the values (the row data).
 
 const (
+	TYPE_NULL  = 0 // the zero Value ,encoded with a 0 tag so it sorts before any other value
 	TYPE_BYTES = 1 // any length / aribitrary length of string
 	TYPE_INT64 = 2 // integer
+	TYPE_FLOAT64   = 3 // float64 ,in `Value.F64`
+	TYPE_BOOL      = 4 // 0 or 1 in `Value.I64`
+	TYPE_TIMESTAMP = 5 // microseconds since the unix epoch (UTC) in `Value.I64`
+	TYPE_DECIMAL   = 6 // fixed point ,the number times 10^DECIMAL_SCALE in `Value.I64`
+	TYPE_JSON      = 7 // a JSON document in `Value.Str` ,see jsonColumns.go
 )
 
+// digits after the decimal point of TYPE_DECIMAL
+const DECIMAL_SCALE = 6
+const DECIMAL_ONE = 1_000_000 // 10^DECIMAL_SCALE
+
+func validType(typ uint32) bool {
+	switch typ {
+	case TYPE_BYTES, TYPE_INT64, TYPE_FLOAT64, TYPE_BOOL, TYPE_TIMESTAMP, TYPE_DECIMAL, TYPE_JSON:
+		return true
+	}
+	return false
+}
+
 const (
 	MODE_UPSERT      = 0 // insert or replace
 	MODE_UPDATE_ONLY = 1 // update existing keys
@@ -35,16 +61,27 @@ type UpdateReq struct {
 	Val  []byte // val associated to key
 	Mode int    // mode insert / update or upsert
 }
+type DeleteReq struct {
+	tree *BTree
+
+	// in
+	Key []byte // key to delete
+	// out
+	Old []byte // the value before the deletion
+}
+
 type DB struct {
-	Path string
-	kv   KV
+	Path  string
+	kv    KV
+	cache tableCache // parsed table definitions ,see tableCache.go
 }
 
 // table cell
 
 type Value struct {
 	Type uint32 // tagged uinon
-	I64  int64  // stores int64
+	I64  int64  // stores int64 ,and the bool ,timestamp and decimal types
+	F64  float64 // stores float64
 	Str  []byte // stores string
 }
 
@@ -68,8 +105,105 @@ func (rec *Record) AddStr(col string, val []byte) *Record {
 	return rec
 }
 
-func (rec *Record) AddInt64(col string, val int64) *Record
-func (rec *Record) Get(col string) *Value
+// add a NULL to a row ,only for nullable columns
+func (rec *Record) AddNull(col string) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_NULL})
+	return rec
+}
+
+func (rec *Record) AddFloat64(col string, val float64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_FLOAT64, F64: val})
+	return rec
+}
+
+func (rec *Record) AddBool(col string, val bool) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_BOOL, I64: qlBool(val)})
+	return rec
+}
+
+// stored in microseconds ,UTC
+func (rec *Record) AddTimestamp(col string, val time.Time) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_TIMESTAMP, I64: val.UnixMicro()})
+	return rec
+}
+
+// `val` is the number times 10^DECIMAL_SCALE ,see `ParseDecimal()`
+func (rec *Record) AddDecimal(col string, val int64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_DECIMAL, I64: val})
+	return rec
+}
+
+// the document is checked on insert
+func (rec *Record) AddJSON(col string, val []byte) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_JSON, Str: val})
+	return rec
+}
+
+// "12.34" -> 12340000
+// an optional `-` ,digits ,and up to `DECIMAL_SCALE` digits after the point
+func ParseDecimal(s string) (int64, error) {
+	num, neg := strings.CutPrefix(s, "-")
+	whole, frac, _ := strings.Cut(num, ".")
+	if !isDigits(whole) || (frac != "" && !isDigits(frac)) || len(frac) > DECIMAL_SCALE {
+		return 0, fmt.Errorf("bad decimal: %q", s)
+	}
+	frac += strings.Repeat("0", DECIMAL_SCALE-len(frac))
+	w, err := strconv.ParseInt(whole, 10, 64)
+	f, _ := strconv.ParseInt(frac, 10, 64) // `DECIMAL_SCALE` digits
+	if err != nil || w > (math.MaxInt64-f)/DECIMAL_ONE {
+		return 0, fmt.Errorf("decimal out of range: %q", s)
+	}
+	v := w*DECIMAL_ONE + f
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+// 1 or more ASCII digits ,no sign
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// 12340000 -> "12.340000"
+func FormatDecimal(v int64) string {
+	sign := ""
+	u := uint64(v)
+	if v < 0 {
+		sign, u = "-", uint64(-v)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, u/DECIMAL_ONE, DECIMAL_SCALE, u%DECIMAL_ONE)
+}
+
+func (rec *Record) AddInt64(col string, val int64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_INT64, I64: val})
+	return rec
+}
+
+// the value of a column ,nil if the row doesnt have it
+func (rec *Record) Get(col string) *Value {
+	for i, c := range rec.Cols {
+		if c == col {
+			return &rec.Vals[i]
+		}
+	}
+	return nil
+}
 
 // Schema design
 
@@ -78,77 +212,221 @@ type TableDef struct {
 	Name  string
 	Types []uint32 // column types (in our case int or string)
 	Cols  []string // column names
+	Nullable []bool // parallel to `Cols` ,empty = no NULLs ,primary key columns cannot be NULL
 	Pkeys int      // tells which column is / are primary keys from start
+	AutoInc bool   // the primary key is 1 INT64 column assigned by `Insert()` ,see autoIncrement.go
 	// primary key can be 0 that mean no primary key
 	// ["id","email","name"] = id and email are primary key ,if Pkeys = 2
 	// auto-assigned B-tree key prefixes for different tables
 	Prefixes []uint32
 	Indexes  [][]string // the first index is the primary key
-
-	//internal
-	db     *DB
-	tdef   *TableDef // which index ?
-	index  *BIter    // Btree iterator
-	keyEnd []byte    // the encoded key2
-
+	Unique   []bool     // parallel to `Indexes` ,a unique index rejects duplicate values
+	Building int        // index that is being backfilled by `IndexNew()` ,0 = none
+	Defaults    []QLNode     // parallel to `Cols` ,empty or QL_UNINIT = no default ,see constraints.go
+	Checks      []Check      // CHECK constraints on the row
+	ForeignKeys []ForeignKey // see foreignKeys.go
+	RefBy       []string     // the tables with a foreign key to this one ,maintained by the db
 }
 
 // predefined internal tabe
 var TDEF_TABLE = &TableDef{
-	Prefix: 2,
-	Name:   "@table",
-	Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
-	Cols:   []string{"name", "def"},
-	Pkeys:  1,
+	Prefixes: []uint32{2},
+	Name:     "@table",
+	Types:    []uint32{TYPE_BYTES, TYPE_BYTES},
+	Cols:     []string{"name", "def"},
+	Pkeys:    1,
+	Indexes:  [][]string{{"name"}},
 }
 
 var TDEF_META = &TableDef{
-	Prefix: 1,
-	Name:   "@meta",
-	Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
-	Cols:   []string{"key", "val"},
-	Pkeys:  1,
+	Prefixes: []uint32{1},
+	Name:     "@meta",
+	Types:    []uint32{TYPE_BYTES, TYPE_BYTES},
+	Cols:     []string{"key", "val"},
+	Pkeys:    1,
+	Indexes:  [][]string{{"key"}},
+}
+
+// the first prefix for user tables ,the ones below are reserved for internal tables
+const TABLE_PREFIX_MIN = 100
+
+// key in `@meta` of the next free prefix
+const META_NEXT_PREFIX = "next_prefix"
+
+// transactions on tables ,a thin layer over the KV transactions
+func (db *DB) Begin(tx *DBTX) {
+	tx.db = db
+	db.kv.Begin(&tx.kv)
+}
+
+func (db *DB) Commit(tx *DBTX) error {
+	if len(tx.ddl) != 0 {
+		return tableCacheCommit(db, tx)
+	}
+	return db.kv.Commit(&tx.kv)
+}
+
+func (db *DB) Abort(tx *DBTX) {
+	db.kv.Abort(&tx.kv)
 }
 
 // get and return a single row by primary key
 func (db *DB) Get(table string, rec *Record) (bool, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	defer db.Abort(&tx) // read only
+	return tx.Get(table, rec)
+}
+
+func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
 	// get the table desc first to understnd the data to retrieve
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found :%s", table)
+	tdef, err := findTableDef(tx, table)
+	if err != nil {
+		return false, err
 	}
 
+	if err := checkUserCols(tdef, *rec); err != nil {
+		return false, err
+	}
 	// provide the tabl desc/definition to get the data
-	return dbGet(db, tdef, rec)
+	ok, err := dbGet(tx, tdef, rec)
+	userRecord(rec)
+	return ok, err
 }
 
 //
 
-func getTableDef(db *DB, name string) *TableDef {
+// the definition of a table ,nil if it doesnt exist
+// the result is shared with other txs ,dont modify it
+func getTableDef(tx *DBTX, name string) (*TableDef, error) {
+	// the tx changed it ,the cache has the committed one
+	ddl := slices.Contains(tx.ddl, name)
+	if !ddl {
+		if tdef := tableCacheGet(tx, name); tdef != nil {
+			// not read from the KV ,but a DDL committed after the tx began is still a conflict
+			key := encodeKey(nil, TDEF_TABLE.Prefixes[0], []Value{{Type: TYPE_BYTES, Str: []byte(name)}})
+			tx.kv.read = append(tx.kv.read, KeyRange{key, key})
+			return tdef, nil
+		}
+	}
+
 	//create empty record //add the name field with the binary data
 	rec := (&Record{}).AddStr("name", []byte(name))
 
-	ok, err := dbGet(db, TDEF_TABLE, rec) //query internal system table
-	assert(err == nil)
+	ok, err := dbGet(tx, TDEF_TABLE, rec) //query internal system table
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
-		return nil // table not found
+		return nil, nil // table not found
 	}
 
 	tdef := &TableDef{}
 	// unmarshall the table def
-	err = json.Unmarshal(rec.Get("def").Str, tdef) //decode JSON scehma
-	assert(err == nil)
-	return tdef //return table schema
+	if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil { //decode JSON scehma
+		return nil, fmt.Errorf("table %s: bad definition: %w", name, err)
+	}
+	if !ddl {
+		tableCachePut(tx, name, tdef)
+	}
+	return tdef, nil //return table schema
+}
+
+// like `getTableDef()` ,but a missing table is an error
+func findTableDef(tx *DBTX, name string) (*TableDef, error) {
+	tdef, err := getTableDef(tx, name)
+	if err == nil && tdef == nil {
+		err = fmt.Errorf("table not found :%s", name)
+	}
+	return tdef, err
+}
+
+// add a new row ,fails with a `*ConstraintError` if the primary key exists
+// returns the id assigned to an auto-increment table ,0 for other tables (see `tx.Insert()`)
+func (db *DB) Insert(table string, rec Record) (int64, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	id, err := tx.Insert(table, rec)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	return id, db.Commit(&tx)
+}
+
+// update an existing row
+func (db *DB) Update(table string, rec Record) (bool, error) {
+	return db.Set(table, rec, MODE_UPDATE_ONLY)
+}
+
+// insert or replace a row
+func (db *DB) Upsert(table string, rec Record) (bool, error) {
+	return db.Set(table, rec, MODE_UPSERT)
+}
+
+// a single row update in its own tx
+func (db *DB) Set(table string, rec Record, mode int) (bool, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	updated, err := tx.Set(table, rec, mode)
+	if err != nil {
+		db.Abort(&tx)
+		return false, err
+	}
+	return updated, db.Commit(&tx)
 }
 
-func (db *DB) Insert(table string, rec Record) (bool, error)
-func (db *DB) Update(table string, rec Record) (bool, error)
-func (db *DB) Upsert(table string, rec Record) (bool, error)
-func (tx *DBTX) Set(table string, rec Record, mode int) (bool, error)
+// update a row and its secondary indexes
+func (tx *DBTX) Set(table string, rec Record, mode int) (bool, error) {
+	tdef, err := findTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	if err := checkUserCols(tdef, rec); err != nil {
+		return false, err
+	}
+	return dbSet(tx, tdef, rec, mode)
+}
+
+// `tx.Set()` ,the row can have `@rowid`
+func dbSet(tx *DBTX, tdef *TableDef, rec Record, mode int) (bool, error) {
+	updated, err := dbUpdate(tx, tdef, rec, mode)
+	if err == nil && updated && tdef.AutoInc {
+		// an id given by the user must not be handed out later
+		err = autoIncSeen(tx, tdef, rec.Get(tdef.Cols[0]).I64)
+	}
+	return updated, err
+}
 // func (db *DB) Delete(table string, rec Record) (bool, error)
-func (tx *DBTX) Delete(table string, rec Record) (bool, error)
 
-func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
+// delete a row by primary key
+func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+	tdef, err := findTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	if err := checkUserCols(tdef, rec); err != nil {
+		return false, err
+	}
+	return fkDelete(tx, tdef, rec)
+}
+
+// `@rowid` is internal ,it is never given by the user
+func checkUserCols(tdef *TableDef, rec Record) error {
+	if slices.Contains(rec.Cols, ROWID_COL) {
+		return fmt.Errorf("table %s: %s is not a user column", tdef.Name, ROWID_COL)
+	}
+	return nil
+}
+
+// hide `@rowid` from a row returned to the user ,it is always the 1st column
+func userRecord(rec *Record) {
+	if len(rec.Cols) > 0 && rec.Cols[0] == ROWID_COL {
+		rec.Cols, rec.Vals = rec.Cols[1:], rec.Vals[1:]
+	}
+}
+
+func dbGet(tx *DBTX, tdef *TableDef, rec *Record) (bool, error) {
 	// check if the record has primary key
 	values, err := checkRecord(tdef, *rec, tdef.Pkeys)
 	if err != nil {
@@ -156,10 +434,10 @@ func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	}
 	// takes primary key and add a prefix using to primary key
 	// which will be used to lookup for data
-	key := encodeKey(nil, tdef.Prefix, values[:tdef.Pkeys])
+	key := encodeKey(nil, tdef.Prefixes[0], values[:tdef.Pkeys])
 
 	// get if the key exists if yes  then give back the encoded data
-	val, ok := db.kv.Get(key)
+	val, ok := tx.kv.Get(key)
 	if !ok {
 		return false, nil
 	}
@@ -173,42 +451,593 @@ func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	return true, nil
 }
 
-func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error)
+// check a row from the user and put its values in table order
+// n == tdef.Pkeys : only the primary key (get ,delete)
+// n == len(tdef.Cols) : the full row ,a missing column gets its default ,or NULL if nullable
+// the returned slice always has all the columns ,the ones not given are zero
+func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
+	assert(n == tdef.Pkeys || n == len(tdef.Cols))
+	if len(rec.Cols) != len(rec.Vals) {
+		return nil, fmt.Errorf("table %s: columns and values dont match", tdef.Name)
+	}
+	values := make([]Value, len(tdef.Cols))
+	given := make([]bool, len(tdef.Cols))
+	for i, col := range rec.Cols {
+		idx := slices.Index(tdef.Cols, col)
+		switch {
+		case idx < 0:
+			return nil, fmt.Errorf("table %s: unknown column: %s", tdef.Name, col)
+		case idx >= n:
+			return nil, fmt.Errorf("table %s: column %s is not a primary key column", tdef.Name, col)
+		case given[idx]:
+			return nil, fmt.Errorf("table %s: duplicate column: %s", tdef.Name, col)
+		}
+		if err := checkValue(tdef, idx, rec.Vals[i]); err != nil {
+			return nil, err
+		}
+		values[idx] = rec.Vals[i]
+		given[idx] = true
+	}
+	for i := 0; i < n; i++ {
+		if given[i] {
+			continue
+		}
+		if hasDefault(tdef, i) {
+			v, err := evalDefault(tdef, i)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+			continue
+		}
+		if i >= tdef.Pkeys && isNullable(tdef, i) {
+			values[i] = Value{Type: TYPE_NULL}
+			continue
+		}
+		return nil, fmt.Errorf("table %s: missing column: %s", tdef.Name, tdef.Cols[i])
+	}
+	return values, nil
+}
 
 // encode columns for the "key" of the KV
 // func encodeKey(out []byte, prefix uint32, vals []Value) []byte
 // decode columns from the "value" of the KV
-func decodeValues(in []byte, out []Value)
+// the types of `out` are set from the table definition
+func decodeValues(in []byte, out []Value) {
+	for i := range out {
+		tag := uint32(in[0])
+		in = in[1:]
+		if tag == TYPE_NULL {
+			out[i] = Value{Type: TYPE_NULL}
+			continue
+		}
+		assert(tag == out[i].Type)
+		switch tag {
+		case TYPE_INT64, TYPE_TIMESTAMP, TYPE_DECIMAL:
+			u := binary.BigEndian.Uint64(in[:8])
+			out[i].I64 = int64(u - (1 << 63)) // flip the sign bit back
+			in = in[8:]
+		case TYPE_FLOAT64:
+			u := binary.BigEndian.Uint64(in[:8])
+			if u&(1<<63) != 0 {
+				u ^= 1 << 63 // was positive
+			} else {
+				u = ^u // was negative
+			}
+			out[i].F64 = math.Float64frombits(u)
+			in = in[8:]
+		case TYPE_BOOL:
+			out[i].I64 = int64(in[0])
+			in = in[1:]
+		case TYPE_BYTES, TYPE_JSON:
+			idx := bytes.IndexByte(in, 0) // null terminated
+			assert(idx >= 0)
+			out[i].Str = unescapeString(in[:idx])
+			in = in[idx+1:]
+		default:
+			panic("what ???")
+		}
+	}
+}
+
+func isNullable(tdef *TableDef, i int) bool {
+	return i < len(tdef.Nullable) && tdef.Nullable[i]
+}
+
+// check the value of the `i`th column
+func checkValue(tdef *TableDef, i int, v Value) error {
+	if v.Type == TYPE_NULL {
+		if !isNullable(tdef, i) {
+			return fmt.Errorf("table %s: column %s cannot be NULL", tdef.Name, tdef.Cols[i])
+		}
+		return nil
+	}
+	if v.Type != tdef.Types[i] {
+		return fmt.Errorf("table %s: column %s: type mismatch", tdef.Name, tdef.Cols[i])
+	}
+	if v.Type == TYPE_BOOL && v.I64 != 0 && v.I64 != 1 {
+		return fmt.Errorf("table %s: column %s: bad bool", tdef.Name, tdef.Cols[i])
+	}
+	if v.Type == TYPE_FLOAT64 && math.IsNaN(v.F64) {
+		return fmt.Errorf("table %s: column %s: NaN is not ordered", tdef.Name, tdef.Cols[i])
+	}
+	if v.Type == TYPE_JSON && !json.Valid(v.Str) {
+		return fmt.Errorf("table %s: column %s: invalid JSON", tdef.Name, tdef.Cols[i])
+	}
+	return nil
+}
 
-func (tree *BTree) Update(req *UpdateReq)
+// convert a number to a column type ,false if it cant be done
+//   - INT64 -> FLOAT64 ,rounded above 2^53
+//   - INT64 -> DECIMAL ,exact ,fails if out of range
+//   - FLOAT64 -> DECIMAL ,exact ,fails if it has more than `DECIMAL_SCALE` digits after the point
+//   - DECIMAL -> FLOAT64 ,rounded like any float (0.1 is not exact)
+//
+// NULL and values of the same type are returned as they are
+func convertValue(v Value, typ uint32) (Value, bool) {
+	switch {
+	case v.Type == typ || v.Type == TYPE_NULL:
+		return v, true
+	case v.Type == TYPE_INT64 && typ == TYPE_FLOAT64:
+		return Value{Type: TYPE_FLOAT64, F64: float64(v.I64)}, true
+	case v.Type == TYPE_INT64 && typ == TYPE_DECIMAL:
+		if v.I64 > math.MaxInt64/DECIMAL_ONE || v.I64 < math.MinInt64/DECIMAL_ONE {
+			return v, false // overflow
+		}
+		return Value{Type: TYPE_DECIMAL, I64: v.I64 * DECIMAL_ONE}, true
+	case v.Type == TYPE_FLOAT64 && typ == TYPE_DECIMAL:
+		// the shortest text that gives the same float ,eg 10.5 and not 10.4999...
+		d, err := ParseDecimal(strconv.FormatFloat(v.F64, 'f', -1, 64))
+		return Value{Type: TYPE_DECIMAL, I64: d}, err == nil
+	case v.Type == TYPE_DECIMAL && typ == TYPE_FLOAT64:
+		return Value{Type: TYPE_FLOAT64, F64: float64(v.I64) / DECIMAL_ONE}, true
+	}
+	return v, false
+}
 
-func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int) (bool, error) {
+func dbUpdate(tx *DBTX, tdef *TableDef, rec Record, mode int) (bool, error) {
 	values, err := checkRecord(tdef, rec, len(tdef.Cols))
 	if err != nil {
 		return false, err
 	}
-	req := UpdateReq{Key: key, Val: val, Mode: mode}
-	if _, err = db.kv.Update(&req); err != nil {
+	// check before writing anything ,so a failed update leaves the tx as it was
+	if err := checkConstraints(tdef, values); err != nil {
+		return false, err
+	}
+	if err := checkUnique(tx, tdef, values); err != nil {
 		return false, err
 	}
+	if err := checkParentRows(tx, tdef, values); err != nil {
+		return false, err
+	}
+	key := encodeKey(nil, tdef.Prefixes[0], values[:tdef.Pkeys])
+	val := encodeValues(nil, values[tdef.Pkeys:])
+
+	// insert the row
+	req := UpdateReq{Key: key, Val: val, Mode: mode}
+	tx.kv.Update(&req)
 	// maintain secondary indexes
 	if req.Updated && !req.Added {
-		// use `req.Old` to delete the old indexed keys ...
+		// use `req.Old` to delete the old indexed keys
+		old := decodeRow(tdef, values[:tdef.Pkeys], req.Old)
+		indexOp(tx, tdef, old, INDEX_DEL)
 	}
 	if req.Updated {
-		// add the new indexed keys ...
+		// add the new indexed keys
+		indexOp(tx, tdef, values, INDEX_ADD)
 	}
-	key := encodeKey(nil, tdef.Prefix, values[:tdef.Pkeys])
-	val := encodeValues(nil, values[tdef.Pkeys:])
-
-	// TODO (FIX THIS)
-	return db.kv.Update(key, val, mode)
 	return req.Updated, nil
 }
 
+const (
+	INDEX_ADD = 1
+	INDEX_DEL = 2
+)
+
+// add or remove the secondary index keys of a row
+// `vals` is the full row in table order
+// an index key is the index columns (primary key included ,see `checkIndexKeys()`)
+// under the index prefix ,the value is empty ,the row is found by its primary key
+// a unique index doesnt include the primary key ,it is stored in the value instead
+func indexOp(tx *DBTX, tdef *TableDef, vals []Value, op int) {
+	// the first index is the primary key ,it is the row itself
+	for i := 1; i < len(tdef.Indexes); i++ {
+		key, pkey := indexKey(tdef, i, vals)
+		// an index being built may not have the key yet ,or already have it
+		building := i == tdef.Building
+		switch op {
+		case INDEX_ADD:
+			req := UpdateReq{Key: key, Val: pkey, Mode: MODE_UPSERT}
+			tx.kv.Update(&req)
+			assert(req.Added || building) // the primary key makes index keys unique
+		case INDEX_DEL:
+			deleted := tx.kv.Del(&DeleteReq{Key: key})
+			assert(deleted || building) // the index must be consistent with the rows
+		default:
+			panic("unreachable")
+		}
+	}
+}
+
+func isUnique(tdef *TableDef, i int) bool {
+	return i < len(tdef.Unique) && tdef.Unique[i]
+}
+
+// the values of the `i`th index columns of a row
+func indexValues(tdef *TableDef, i int, vals []Value) []Value {
+	ivals := make([]Value, 0, len(tdef.Indexes[i]))
+	for _, col := range tdef.Indexes[i] {
+		ivals = append(ivals, indexValue(tdef, col, vals))
+	}
+	return ivals
+}
+
+func hasNull(vals []Value) bool {
+	return slices.ContainsFunc(vals, func(v Value) bool { return v.Type == TYPE_NULL })
+}
+
+// the key of a row in the `i`th index ,and the value to store with it
+// NULLs are never equal ,so in a unique index a key with a NULL gets the primary key
+// appended ,like a normal index ,to keep the rows apart
+func indexKey(tdef *TableDef, i int, vals []Value) ([]byte, []byte) {
+	ivals := indexValues(tdef, i, vals)
+	key := encodeKey(nil, tdef.Prefixes[i], ivals)
+	if !isUnique(tdef, i) {
+		return key, nil
+	}
+	pkey := encodeValues(nil, vals[:tdef.Pkeys])
+	if hasNull(ivals) {
+		key = append(key, pkey...)
+	}
+	return key, pkey
+}
+
+// a unique index key can only be used by the row with the same primary key
+// a key with a NULL doesnt conflict with anything
+// a concurrent tx that adds the same key fails to commit ,the key is read here (see `detectConflicts()`)
+func checkUnique(tx *DBTX, tdef *TableDef, vals []Value) error {
+	for i := 1; i < len(tdef.Indexes); i++ {
+		if !isUnique(tdef, i) || hasNull(indexValues(tdef, i, vals)) {
+			continue
+		}
+		key, pkey := indexKey(tdef, i, vals)
+		if other, ok := tx.kv.Get(key); ok && !bytes.Equal(other, pkey) {
+			return &ConstraintError{
+				Table:      tdef.Name,
+				Constraint: indexName(tdef, i),
+				Msg:        "duplicate value",
+			}
+		}
+	}
+	return nil
+}
+
+// name of a unique index in errors ,eg `unique(email)`
+func indexName(tdef *TableDef, i int) string {
+	cols := tdef.Indexes[i]
+	return fmt.Sprintf("unique(%s)", strings.Join(cols, ","))
+}
+
+// the full row from the primary key and the encoded value
+func decodeRow(tdef *TableDef, pkey []Value, val []byte) []Value {
+	vals := make([]Value, len(tdef.Cols))
+	copy(vals, pkey)
+	for i := tdef.Pkeys; i < len(tdef.Cols); i++ {
+		vals[i].Type = tdef.Types[i]
+	}
+	decodeValues(val, vals[tdef.Pkeys:])
+	return vals
+}
+
+func dbDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
+	values, err := checkRecord(tdef, rec, tdef.Pkeys)
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(nil, tdef.Prefixes[0], values[:tdef.Pkeys])
+	req := DeleteReq{Key: key}
+	deleted := tx.kv.Del(&req)
+	if !deleted {
+		return false, nil
+	}
+	// maintain secondary indexes
+	if len(tdef.Indexes) > 1 {
+		old := decodeRow(tdef, values[:tdef.Pkeys], req.Old)
+		indexOp(tx, tdef, old, INDEX_DEL)
+	}
+	return true, nil
+}
+
+// create a new table
+// the definition is checked ,gets its key prefixes and is stored in `@table`
+// `tdef` is not modified
+func (db *DB) TableNew(tdef *TableDef) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	if err := tx.TableNew(tdef); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+func (tx *DBTX) TableNew(tdef *TableDef) error {
+	tdef = cloneTableDef(tdef) // the checks fill in the definition ,the caller's stays as it was
+	if err := tableDefCheck(tdef); err != nil {
+		return err
+	}
+
+	// check the existing table
+	table := (&Record{}).AddStr("name", []byte(tdef.Name))
+	ok, err := dbGet(tx, TDEF_TABLE, table)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("table exists: %s", tdef.Name)
+	}
+	if err := foreignKeyLink(tx, tdef); err != nil {
+		return err
+	}
+
+	// allocate new prefixes ,1 for each index (the primary key is the 1st index)
+	prefix, err := allocPrefixes(tx, len(tdef.Indexes))
+	if err != nil {
+		return err
+	}
+	tdef.Prefixes = nil
+	for i := range tdef.Indexes {
+		tdef.Prefixes = append(tdef.Prefixes, prefix+uint32(i))
+	}
+
+	// store the definition
+	val, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	table.AddStr("def", val)
+	tableDefChanged(tx, tdef.Name)
+	_, err = dbUpdate(tx, TDEF_TABLE, *table, MODE_INSERT_ONLY)
+	return err
+}
+
+// take `n` prefixes from the counter in `@meta`
+// returns the 1st one ,the rest follow it
+func allocPrefixes(tx *DBTX, n int) (uint32, error) {
+	prefix := uint32(TABLE_PREFIX_MIN)
+	meta := (&Record{}).AddStr("key", []byte(META_NEXT_PREFIX))
+	ok, err := dbGet(tx, TDEF_META, meta)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
+		assert(prefix >= TABLE_PREFIX_MIN)
+	}
+
+	next := make([]byte, 4)
+	binary.LittleEndian.PutUint32(next, prefix+uint32(n))
+	meta = (&Record{}).AddStr("key", []byte(META_NEXT_PREFIX)).AddStr("val", next)
+	if _, err := dbUpdate(tx, TDEF_META, *meta, MODE_UPSERT); err != nil {
+		return 0, err
+	}
+	return prefix, nil
+}
+
+// check a user defined table and fill in the index list
+func tableDefCheck(tdef *TableDef) error {
+	if tdef.Name == "" || strings.HasPrefix(tdef.Name, "@") {
+		return fmt.Errorf("bad table name: %q", tdef.Name) // `@` is for internal tables
+	}
+	if len(tdef.Cols) == 0 || len(tdef.Cols) != len(tdef.Types) {
+		return fmt.Errorf("table %s: columns and types dont match", tdef.Name)
+	}
+	if tdef.Pkeys < 0 || tdef.Pkeys > len(tdef.Cols) {
+		return fmt.Errorf("table %s: bad number of primary keys: %d", tdef.Name, tdef.Pkeys)
+	}
+	if len(tdef.Prefixes) != 0 || tdef.Building != 0 {
+		return fmt.Errorf("table %s: prefixes are assigned by the db", tdef.Name)
+	}
+	for i, col := range tdef.Cols {
+		if col == "" || strings.HasPrefix(col, "@") || strings.Contains(col, JSON_PATH_OP) {
+			return fmt.Errorf("table %s: bad column name: %q", tdef.Name, col)
+		}
+		if slices.Contains(tdef.Cols[:i], col) {
+			return fmt.Errorf("table %s: duplicate column: %s", tdef.Name, col)
+		}
+		if !validType(tdef.Types[i]) {
+			return fmt.Errorf("table %s: column %s: bad type: %d", tdef.Name, col, tdef.Types[i])
+		}
+	}
+
+	if err := autoIncCheck(tdef); err != nil {
+		return err
+	}
+	if len(tdef.Nullable) != 0 && len(tdef.Nullable) != len(tdef.Cols) {
+		return fmt.Errorf("table %s: columns and nullable flags dont match", tdef.Name)
+	}
+	for i := 0; i < tdef.Pkeys; i++ {
+		if isNullable(tdef, i) {
+			return fmt.Errorf("table %s: primary key column %s cannot be NULL", tdef.Name, tdef.Cols[i])
+		}
+	}
+	if err := constraintsDefCheck(tdef); err != nil {
+		return err
+	}
+	if len(tdef.Unique) != 0 && len(tdef.Unique) != len(tdef.Indexes) {
+		return fmt.Errorf("table %s: indexes and unique flags dont match", tdef.Name)
+	}
+
+	// the first index is the primary key
+	// it is unique by itself ,`Unique[0]` is false as it has no separate index keys
+	pkey := tdef.Cols[:tdef.Pkeys]
+	indexes := [][]string{pkey}
+	unique := []bool{false}
+	for i, index := range tdef.Indexes {
+		if slices.Equal(index, pkey) {
+			continue // the primary key is listed by the user ,it is already the first one
+		}
+		u := len(tdef.Unique) != 0 && tdef.Unique[i]
+		index, err := checkIndexKeys(tdef, index, u)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, index)
+		unique = append(unique, u)
+	}
+	tdef.Indexes = indexes
+	tdef.Unique = unique
+	return foreignKeyDefCheck(tdef)
+}
 
-// TODO
-func (db *DB) TableNew(tdef *TableDef) error
+// a secondary index points to the row by its primary key ,so the primary key
+// is appended to the index columns ,this also makes every index key unique
+// a unique index keeps only its columns ,the primary key goes into the value
+func checkIndexKeys(tdef *TableDef, index []string, unique bool) ([]string, error) {
+	if len(index) == 0 {
+		return nil, fmt.Errorf("table %s: empty index", tdef.Name)
+	}
+	for i, col := range index {
+		if err := checkIndexColumn(tdef, col); err != nil {
+			return nil, err
+		}
+		if slices.Contains(index[:i], col) {
+			return nil, fmt.Errorf("table %s: index: duplicate column: %s", tdef.Name, col)
+		}
+	}
+	index = slices.Clone(index)
+	if unique {
+		return index, nil
+	}
+	for _, col := range tdef.Cols[:tdef.Pkeys] {
+		if !slices.Contains(index, col) {
+			index = append(index, col)
+		}
+	}
+	return index, nil
+}
+
+// delete a table with all its rows and index entries
+// the definition is removed in 1 tx ,then the keys are deleted in small txs (see `dropKeyPrefix()`)
+// the pages of the deleted keys go back to the free list on commit
+func (db *DB) TableDrop(name string) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	tdef, err := tableDrop(&tx, name)
+	if err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	if err := db.Commit(&tx); err != nil {
+		return err
+	}
+	for _, prefix := range tdef.Prefixes {
+		if err := dropKeyPrefix(db, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// like `DB.TableDrop()` ,but the keys are deleted in this tx
+func (tx *DBTX) TableDrop(name string) error {
+	tdef, err := tableDrop(tx, name)
+	if err != nil {
+		return err
+	}
+	// the rows and every index ,each has its own prefix
+	for _, prefix := range tdef.Prefixes {
+		deleteKeyPrefix(tx, prefix)
+	}
+	return nil
+}
+
+// remove the definition ,the caller deletes the keys
+func tableDrop(tx *DBTX, name string) (*TableDef, error) {
+	if strings.HasPrefix(name, "@") {
+		return nil, fmt.Errorf("cannot drop internal table: %s", name)
+	}
+	tdef, err := findTableDef(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := foreignKeyUnlink(tx, tdef); err != nil {
+		return nil, err
+	}
+	if tdef.AutoInc {
+		meta := (&Record{}).AddStr("key", []byte(META_NEXT_ID+name))
+		if _, err := dbDelete(tx, TDEF_META, *meta); err != nil {
+			return nil, err
+		}
+	}
+	tableDefChanged(tx, name)
+	table := (&Record{}).AddStr("name", []byte(name))
+	_, err = dbDelete(tx, TDEF_TABLE, *table)
+	return tdef, err
+}
+
+// keys per tx when the keys of a dropped table or index are deleted
+const DROP_BATCH = 1000
+
+// delete the keys of a prefix that is no longer in any `TableDef` ,in small txs
+// like the backfill of `IndexNew()` ,so a big table doesnt make a huge tx.
+// prefixes are never reused ,no other tx reads or writes these keys.
+// if the process stops before it is done the rest of the keys stay in the file ,
+// they are never read
+func dropKeyPrefix(db *DB, prefix uint32) error {
+	var start []byte // the last key deleted
+	for {
+		tx := DBTX{}
+		db.Begin(&tx)
+		next := deleteKeyBatch(&tx, prefix, start)
+		if next == nil {
+			db.Abort(&tx)
+			return nil // no more keys
+		}
+		err := db.Commit(&tx)
+		if errors.Is(err, ErrTxConflict) {
+			continue // retry the batch
+		}
+		if err != nil {
+			return err
+		}
+		start = next
+	}
+}
+
+// delete every key starting with the 4-byte prefix ,in this tx
+func deleteKeyPrefix(tx *DBTX, prefix uint32) {
+	start := deleteKeyBatch(tx, prefix, nil)
+	for start != nil {
+		start = deleteKeyBatch(tx, prefix, start)
+	}
+}
+
+// delete up to `DROP_BATCH` keys with the prefix after `start` (nil = from the 1st one)
+// returns the last key deleted ,or nil if there were none
+func deleteKeyBatch(tx *DBTX, prefix uint32, start []byte) []byte {
+	first := encodeKey(nil, prefix, nil)
+	cmp := CMP_GT
+	if start == nil {
+		start, cmp = first, CMP_GE
+	}
+	// collect the keys first ,the iterator would be invalidated by the deletes
+	keys := [][]byte(nil)
+	for iter := tx.kv.Seek(start, cmp); iter.Valid() && len(keys) < DROP_BATCH; iter.Next() {
+		key, _ := iter.Deref()
+		if !bytes.HasPrefix(key, first) {
+			break
+		}
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	for _, key := range keys {
+		tx.kv.Del(&DeleteReq{Key: key})
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[len(keys)-1]
+}
 
 // func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int) (bool, error) {
 // 	// ...
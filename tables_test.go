@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func userRow(id int64, email string) Record {
+	return *(&Record{}).AddInt64("id", id).AddStr("email", []byte(email))
+}
+
+func newUsersTable(t *testing.T, db *DB) {
+	t.Helper()
+	err := db.TableNew(&TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"id", "email"},
+		Pkeys:   1,
+		Indexes: [][]string{{"id"}},
+	})
+	if err == nil {
+		err = db.IndexNew("users", []string{"email"}, true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	db := openTestDB(t)
+	newUsersTable(t, db)
+	if _, err := db.Upsert("users", userRow(1, "a@x")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Upsert("users", userRow(2, "a@x"))
+	cerr := (*ConstraintError)(nil)
+	if !errors.As(err, &cerr) {
+		t.Fatalf("got %v", err)
+	}
+	// the same row can keep its value
+	if _, err := db.Upsert("users", userRow(1, "a@x")); err != nil {
+		t.Fatal(err)
+	}
+	// the value is free again after it is changed
+	if _, err := db.Upsert("users", userRow(1, "b@x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert("users", userRow(2, "a@x")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 2 txs insert the same value ,each one alone doesnt see a duplicate.
+// the 2nd commit fails because it read the index key the 1st one wrote.
+func TestUniqueConcurrentInsert(t *testing.T) {
+	db := openTestDB(t)
+	newUsersTable(t, db)
+
+	tx1, tx2 := DBTX{}, DBTX{}
+	db.Begin(&tx1)
+	db.Begin(&tx2)
+	if _, err := tx1.Set("users", userRow(1, "a@x"), MODE_INSERT_ONLY); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx2.Set("users", userRow(2, "a@x"), MODE_INSERT_ONLY); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx2); !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("got %v", err)
+	}
+
+	// only the 1st row is there
+	rec := *(&Record{}).AddInt64("id", 2)
+	if ok, err := db.Get("users", &rec); ok || err != nil {
+		t.Fatalf("got %v %v", ok, err)
+	}
+}
+
+func TestAutoIncrement(t *testing.T) {
+	db := openTestDB(t)
+	err := db.TableNew(&TableDef{
+		Name:    "t",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"id", "v"},
+		Pkeys:   1,
+		Indexes: [][]string{{"id"}},
+		AutoInc: true,
+	})
+	if err == nil {
+		// no primary key
+		err = db.TableNew(&TableDef{Name: "log", Types: []uint32{TYPE_BYTES}, Cols: []string{"v"}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := *(&Record{}).AddStr("v", []byte("x"))
+	for want := int64(1); want <= 2; want++ {
+		if id, err := db.Insert("t", row); err != nil || id != want {
+			t.Fatalf("got %d %v ,expected %d", id, err, want)
+		}
+	}
+	if id, err := db.Insert("log", row); err != nil || id != 0 {
+		t.Fatalf("got %d %v", id, err)
+	}
+
+	// 2 txs take the same id ,the 2nd commit fails
+	tx1, tx2 := DBTX{}, DBTX{}
+	db.Begin(&tx1)
+	db.Begin(&tx2)
+	for _, tx := range []*DBTX{&tx1, &tx2} {
+		if id, err := tx.Insert("t", row); err != nil || id != 3 {
+			t.Fatalf("got %d %v", id, err)
+		}
+	}
+	if err := db.Commit(&tx1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx2); !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	good := map[string]int64{
+		"12.34": 12*DECIMAL_ONE + 34*DECIMAL_ONE/100,
+		"-1.5":  -DECIMAL_ONE - DECIMAL_ONE/2,
+		"7":     7 * DECIMAL_ONE,
+		"0.":    0,
+	}
+	for s, want := range good {
+		if got, err := ParseDecimal(s); err != nil || got != want {
+			t.Errorf("%s: got %d %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "-", ".5", "1.+5", "+1", "1.-5", "--1", "1e3", "1.2.3", "1.1234567", "99999999999999999999"} {
+		_, err := ParseDecimal(s)
+		if err == nil {
+			t.Errorf("%q: no error", s)
+		} else if !strings.Contains(err.Error(), strconv.Quote(s)) {
+			t.Errorf("%q: %v", s, err) // the input as it was given
+		}
+	}
+	if got := FormatDecimal(-DECIMAL_ONE / 2); got != "-0.500000" {
+		t.Errorf("got %s", got)
+	}
+}
+
+// the definition is completed on a copy
+func TestTableNewKeepsDef(t *testing.T) {
+	db := openTestDB(t)
+	tdef := &TableDef{Name: "t", Types: []uint32{TYPE_BYTES}, Cols: []string{"v"}, Nullable: []bool{true}}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tdef.Cols, []string{"v"}) || !reflect.DeepEqual(tdef.Nullable, []bool{true}) ||
+		tdef.Pkeys != 0 || tdef.AutoInc || tdef.Prefixes != nil || tdef.Indexes != nil {
+		t.Fatalf("got %+v", tdef)
+	}
+	// the stored one has the row id and the prefixes
+	tx := DBTX{}
+	db.Begin(&tx)
+	defer db.Abort(&tx)
+	if got := readTableDef(t, &tx, "t"); got.Cols[0] != ROWID_COL || len(got.Prefixes) != 1 {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+// the number of keys with the prefix
+func countPrefix(db *DB, prefix uint32) int {
+	tx := DBTX{}
+	db.Begin(&tx)
+	defer db.Abort(&tx)
+	start := encodeKey(nil, prefix, nil)
+	n := 0
+	for iter := tx.kv.Seek(start, CMP_GE); iter.Valid(); iter.Next() {
+		if key, _ := iter.Deref(); !bytes.HasPrefix(key, start) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// more keys than a batch of `dropKeyPrefix()`
+func TestTableDropBatches(t *testing.T) {
+	db := openTestDB(t)
+	newUsersTable(t, db)
+	tx := DBTX{}
+	db.Begin(&tx)
+	for i := 0; i < DROP_BATCH*2+10; i++ {
+		if _, err := tx.Set("users", userRow(int64(i), strconv.Itoa(i)), MODE_INSERT_ONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	db.Begin(&tx)
+	prefixes := readTableDef(t, &tx, "users").Prefixes
+	db.Abort(&tx)
+
+	if err := db.IndexDrop("users", []string{"email"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(db, prefixes[1]); n != 0 {
+		t.Fatalf("index keys left: %d", n)
+	}
+	if n := countPrefix(db, prefixes[0]); n != DROP_BATCH*2+10 {
+		t.Fatalf("rows: %d", n)
+	}
+	version := db.kv.version
+	if err := db.TableDrop("users"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(db, prefixes[0]); n != 0 {
+		t.Fatalf("rows left: %d", n)
+	}
+	// the definition ,then 3 batches of rows
+	if n := db.kv.version - version; n != 4 {
+		t.Fatalf("%d txs", n)
+	}
+	if _, err := db.Get("users", (&Record{}).AddInt64("id", 1)); err == nil {
+		t.Fatal("the table is still there")
+	}
+}